@@ -0,0 +1,205 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Slide decks may come as a single zip, tar or gzip-compressed tar archive.
+// Images are read straight from it rather than unpacked to disk.
+
+func isArchive(path string) bool {
+	lower := strings.ToLower(path)
+	for _, suffix := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(lower, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Where a file's content lies within an uncompressed tar, to read it again
+// without going through the files before. The offset is 0 in other archives.
+type tarSection struct {
+	offset int64
+	size   int64
+}
+
+// Call visit with the name of each file in the archive, in order, until it
+// returns false. Reading the file's content is only possible during the call.
+func walkArchive(archivePath string, visit func(name string, section tarSection, read func() ([]byte, error)) bool) error {
+	lower := strings.ToLower(archivePath)
+	if strings.HasSuffix(lower, ".zip") {
+		zipR, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return err
+		}
+		defer zipR.Close()
+		for _, file := range zipR.File {
+			if file.FileInfo().IsDir() {
+				continue
+			}
+			read := func() ([]byte, error) {
+				entryR, err := file.Open()
+				if err != nil {
+					return nil, err
+				}
+				defer entryR.Close()
+				return io.ReadAll(entryR)
+			}
+			if !visit(file.Name, tarSection{}, read) {
+				break
+			}
+		}
+		return nil
+	}
+
+	archiveF, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer archiveF.Close()
+	var archiveR io.Reader = archiveF
+	compressed := !strings.HasSuffix(lower, ".tar")
+	if compressed {
+		gzipR, err := gzip.NewReader(archiveF)
+		if err != nil {
+			return err
+		}
+		defer gzipR.Close()
+		archiveR = gzipR
+	}
+	tarR := tar.NewReader(archiveR)
+	for {
+		header, err := tarR.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		section := tarSection{}
+		if !compressed {
+			// The tar reader reads no further than the header
+			if section.offset, err = archiveF.Seek(0, io.SeekCurrent); err != nil {
+				return err
+			}
+			section.size = header.Size
+		}
+		read := func() ([]byte, error) {
+			return io.ReadAll(tarR)
+		}
+		if !visit(header.Name, section, read) {
+			return nil
+		}
+	}
+}
+
+// List the images of an archive this build can decode, in archive order.
+// Those of a compressed tar are read along, as it can only be read from its
+// start: going through it again for each image would take ever longer.
+func readArchive(archivePath string, transforms []string) ([]imgContext, error) {
+	lower := strings.ToLower(archivePath)
+	compressed := !strings.HasSuffix(lower, ".zip") && !strings.HasSuffix(lower, ".tar")
+	entries := []imgContext{}
+	var readErr error
+	err := walkArchive(archivePath, func(name string, section tarSection, read func() ([]byte, error)) bool {
+		if _, ok := formatExtensions[strings.ToLower(filepath.Ext(name))]; ok {
+			entry := imgContext{
+				path:       archivePath + "/" + name,
+				archive:    archivePath,
+				entry:      name,
+				section:    section,
+				transforms: transforms,
+				weight:     1,
+			}
+			if compressed {
+				if entry.data, readErr = read(); readErr != nil {
+					return false
+				}
+			}
+			entries = append(entries, entry)
+		}
+		return true
+	})
+	if err == nil {
+		err = readErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", archivePath, err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s: no image in the archive", archivePath)
+	}
+	return entries, nil
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// Open an image file, or read it from its archive into memory, or from the
+// content of its data URI or compressed archive read beforehand.
+func openImage(imageContext imgContext) (io.ReadSeekCloser, error) {
+	if imageContext.data != nil {
+		return nopCloser{bytes.NewReader(imageContext.data)}, nil
+	}
+	if imageContext.archive == "" {
+		return os.Open(imageContext.path)
+	}
+	if imageContext.section.offset > 0 {
+		content, err := readTarSection(imageContext.archive, imageContext.section)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", imageContext.path, err)
+		}
+		return nopCloser{bytes.NewReader(content)}, nil
+	}
+	var content []byte
+	var readErr error
+	found := false
+	err := walkArchive(imageContext.archive, func(name string, section tarSection, read func() ([]byte, error)) bool {
+		if name != imageContext.entry {
+			return true
+		}
+		content, readErr = read()
+		found = true
+		return false
+	})
+	if err == nil {
+		err = readErr
+	}
+	if err == nil && !found {
+		err = fmt.Errorf("no longer in %s", imageContext.archive)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", imageContext.path, err)
+	}
+	return nopCloser{bytes.NewReader(content)}, nil
+}
+
+func readTarSection(archivePath string, section tarSection) ([]byte, error) {
+	archiveF, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer archiveF.Close()
+	content := make([]byte, section.size)
+	if _, err := archiveF.ReadAt(content, section.offset); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
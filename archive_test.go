@@ -0,0 +1,80 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Write a tar archive of the given files, compressed if its name says so.
+func writeTar(t *testing.T, archivePath string, names []string, contents []string) {
+	var archive bytes.Buffer
+	var w io.Writer = &archive
+	var gzipW *gzip.Writer
+	if filepath.Ext(archivePath) == ".tgz" {
+		gzipW = gzip.NewWriter(&archive)
+		w = gzipW
+	}
+	tarW := tar.NewWriter(w)
+	for i, name := range names {
+		if err := tarW.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(contents[i])), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tarW.Write([]byte(contents[i])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tarW.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gzipW != nil {
+		if err := gzipW.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(archivePath, archive.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Images of tars are read without going through the archive again for each.
+func TestReadTar(t *testing.T) {
+	var ext string
+	for ext = range formatExtensions {
+		break
+	}
+	names := []string{"first" + ext, "second" + ext, "notes.txt", "third" + ext}
+	contents := []string{"one", "two", "ignored", "three"}
+	for _, archiveName := range []string{"deck.tar", "deck.tgz"} {
+		archivePath := filepath.Join(t.TempDir(), archiveName)
+		writeTar(t, archivePath, names, contents)
+		entries, err := readArchive(archivePath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 3 {
+			t.Fatalf("%s lists %d images, want 3", archiveName, len(entries))
+		}
+		for i, want := range []string{"one", "two", "three"} {
+			if archiveName == "deck.tar" && entries[i].section.offset == 0 {
+				t.Errorf("%s: %s has no offset", archiveName, entries[i].entry)
+			}
+			if archiveName == "deck.tgz" && entries[i].data == nil {
+				t.Errorf("%s: %s was not read along", archiveName, entries[i].entry)
+			}
+			imgF, err := openImage(entries[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := io.ReadAll(imgF)
+			imgF.Close()
+			if err != nil || string(content) != want {
+				t.Errorf("%s: %s holds %q, want %q", archiveName, entries[i].entry, content, want)
+			}
+		}
+	}
+}
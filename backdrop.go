@@ -0,0 +1,37 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/disintegration/imaging"
+)
+
+// Image shown behind every image with --bgimage, covering the whole screen.
+type backdrop struct {
+	path  string
+	image image.Image
+}
+
+func (back *backdrop) UnmarshalText(text []byte) error {
+	back.path = string(text)
+	return nil
+}
+
+// Decode the backdrop and crop it to fill the screen, over black where it is
+// transparent, so that images only need blending over it.
+func (back *backdrop) load(args args, screen_width int, screen_height int) error {
+	backArgs := args
+	backArgs.Verbose = false
+	backContext, err := decodeImage(imgContext{path: back.path, weight: 1}, backArgs)
+	if err != nil {
+		return err
+	}
+	filled := imaging.Fill(backContext.decoded[0], screen_width, screen_height, imaging.Center, imaging.Lanczos)
+	opaque := image.NewNRGBA(filled.Bounds())
+	draw.Draw(opaque, opaque.Bounds(), image.NewUniform(color.Black), image.Point{}, draw.Src)
+	draw.Draw(opaque, opaque.Bounds(), filled, image.Point{}, draw.Over)
+	back.image = opaque
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Decode, transform and draw every image the given number of times into a
+// screen held in memory, sized as for --dryrun, then report how long each
+// phase takes and how many megapixels per second it goes through, to
+// compare filters and pixel formats on the hardware at hand.
+func bench(sources []imgContext, args args) error {
+	if len(sources) == 0 {
+		return fmt.Errorf("%w: no image to measure", errUsage)
+	}
+	screen_width, screen_height := dryRunWidth, dryRunHeight
+	depth := uint32(32)
+	if args.Geometry != nil {
+		screen_width, screen_height = args.Geometry.width, args.Geometry.height
+		depth = uint32(args.Geometry.depth)
+	}
+	// Bytes per pixel follow the depth, as for a screen, see detectPixelFormat
+	format := pixelFormats[depthFormats[depth]]
+	format.bytes = depthBytes(depth)
+	if args.PixelFormat != "" {
+		var ok bool
+		format, ok = pixelFormats[args.PixelFormat]
+		if !ok {
+			return fmt.Errorf("%w: unknown pixel format: %s", errUsage, args.PixelFormat)
+		}
+		if args.Geometry != nil && format.bytes != depthBytes(depth) {
+			return fmt.Errorf("%w: %s takes %d bytes per pixel, the screen has %d bits per pixel",
+				errPixelFormat, args.PixelFormat, format.bytes, depth)
+		}
+	}
+	format.opaque = args.NoAlpha
+	if format.bytes == 1 {
+		format.palette = newPalette()
+	}
+	screen := screenBuffer{
+		pixels: make([]byte, screen_width*screen_height*format.bytes),
+		width:  screen_width,
+		height: screen_height,
+		stride: screen_width,
+		format: format,
+		linear: args.LinearBlend,
+	}
+	// Timing output would be drowned in the details
+	args.Verbose = false
+
+	fmt.Printf("%d runs on a %dx%d screen at %d bytes per pixel\n", args.Bench, screen_width, screen_height, format.bytes)
+	for _, source := range sources {
+		var decoded, placed imgContext
+		var err error
+		decodeTime := measure(args.Bench, func() {
+			decoded, err = decodeImage(source, args)
+		})
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInput, err)
+		}
+		transformTime := measure(args.Bench, func() {
+			placed = decoded
+			err = placeImage(&placed, args, screen_width, screen_height)
+		})
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInput, err)
+		}
+		if format.palette != nil {
+			format.palette.update(placed.image)
+		}
+		packTime := measure(args.Bench, func() {
+			if args.Compose {
+				composeImage(screen, placed)
+			} else {
+				drawImage(screen, placed)
+			}
+		})
+
+		decodedBounds := decoded.decoded[0].Bounds()
+		decodedPixels := decodedBounds.Dx() * decodedBounds.Dy()
+		shownPixels := placed.image_width * placed.image_height
+		if args.Compose {
+			shownPixels = screen_width * screen_height
+		}
+		fmt.Printf("\n%s: %dx%d, shown as %dx%d\n", source.path,
+			decodedBounds.Dx(), decodedBounds.Dy(), placed.image_width, placed.image_height)
+		fmt.Printf("%-10s %12s %10s\n", "phase", "per run", "MP/s")
+		fmt.Printf("%-10s %12v %10.1f\n", "decode", decodeTime, megapixelRate(decodedPixels, decodeTime))
+		fmt.Printf("%-10s %12v %10.1f\n", "transform", transformTime, megapixelRate(decodedPixels, transformTime))
+		fmt.Printf("%-10s %12v %10.1f\n", "pack", packTime, megapixelRate(shownPixels, packTime))
+	}
+	return nil
+}
+
+// Average time a function takes over a number of runs.
+func measure(runs int, run func()) time.Duration {
+	start := time.Now()
+	for i := 0; i < runs; i++ {
+		run()
+	}
+	return (time.Since(start) / time.Duration(runs)).Round(time.Microsecond)
+}
+
+func megapixelRate(pixels int, duration time.Duration) float64 {
+	if duration <= 0 {
+		return 0
+	}
+	return float64(pixels) / 1e6 / duration.Seconds()
+}
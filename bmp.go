@@ -0,0 +1,11 @@
+//go:build bmp || !(png || jpeg || gif || webp || tiff || qoi || ico)
+
+package main
+
+import (
+	"golang.org/x/image/bmp"
+)
+
+func init() {
+	registerDecoder("bmp", []string{".bmp"}, imageDecoder{singleFrame(bmp.Decode), bmp.DecodeConfig})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Color correction given as 9 comma-separated factors, row by row, or 12 when
+// each row ends with an offset from 0 to 255:
+// red = r*m[0][0] + g*m[0][1] + b*m[0][2] + m[0][3], and so on for green and blue.
+type matrix [3][4]float64
+
+func (m *matrix) UnmarshalText(text []byte) error {
+	fields := strings.Split(string(text), ",")
+	if len(fields) != 9 && len(fields) != 12 {
+		return fmt.Errorf("invalid color matrix: %s, expected 9 or 12 comma-separated numbers", text)
+	}
+	*m = matrix{}
+	columns := len(fields) / 3
+	for i, field := range fields {
+		value, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return fmt.Errorf("invalid color matrix: %s: %v", text, err)
+		}
+		m[i/columns][i%columns] = value
+	}
+	return nil
+}
+
+// Corrected copy of an image, leaving the alpha channel alone.
+func (m *matrix) apply(img image.Image) *image.NRGBA {
+	bounds := img.Bounds()
+	corrected := image.NewNRGBA(bounds)
+	channel := func(row [4]float64, pixel color.NRGBA) uint8 {
+		value := float64(pixel.R)*row[0] + float64(pixel.G)*row[1] + float64(pixel.B)*row[2] + row[3]
+		return uint8(math.Max(0, math.Min(255, math.Round(value))))
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			pixel := img.At(x, y).(color.NRGBA)
+			corrected.SetNRGBA(x, y, color.NRGBA{channel(m[0], pixel), channel(m[1], pixel), channel(m[2], pixel), pixel.A})
+		}
+	}
+	return corrected
+}
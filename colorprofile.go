@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+	"math"
+)
+
+// Conversion of an image's embedded color profile to sRGB, the color space
+// the screen is assumed to show: each channel is turned into linear light
+// along the profile's curve, then mixed to sRGB primaries.
+type colorProfile struct {
+	linear [3][256]float64
+	toSRGB [3][3]float64
+}
+
+// Linear sRGB from CIE XYZ relative to D50, the connection space of ICC
+// profiles, with Bradford adaptation to the D65 white of sRGB.
+var xyzD50ToSRGB = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+// sRGB values for linear light in steps of 1/4095, finer than 8 bits so that
+// dark tones keep their precision.
+var srgbValues [4096]uint8
+
+func init() {
+	for i := range srgbValues {
+		srgbValues[i] = srgbValue(float64(i) / 4095)
+	}
+}
+
+// Profile of an image only tagged with the gamma it was encoded with, as in
+// 0.45455 for the usual 1/2.2, with sRGB primaries.
+func gammaProfile(gamma float64) *colorProfile {
+	profile := &colorProfile{toSRGB: [3][3]float64{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}}
+	for c := range profile.linear {
+		for v := range profile.linear[c] {
+			profile.linear[c][v] = math.Pow(float64(v)/255, 1/gamma)
+		}
+	}
+	return profile
+}
+
+// Whether converting would change no pixel value, as for the many images
+// tagged with an sRGB profile.
+func (profile *colorProfile) srgb() bool {
+	for i := range profile.toSRGB {
+		for j := range profile.toSRGB[i] {
+			identity := 0.0
+			if i == j {
+				identity = 1
+			}
+			if math.Abs(profile.toSRGB[i][j]-identity) > 0.01 {
+				return false
+			}
+		}
+	}
+	for c := range profile.linear {
+		for v := range profile.linear[c] {
+			if math.Abs(float64(srgbValue(profile.linear[c][v]))-float64(v)) > 1 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Convert an image to sRGB, leaving its alpha channel as is.
+func (profile *colorProfile) apply(img image.Image) *image.NRGBA {
+	converted, ok := img.(*image.NRGBA)
+	if !ok {
+		converted = image.NewNRGBA(img.Bounds())
+		draw.Draw(converted, converted.Rect, img, img.Bounds().Min, draw.Src)
+	}
+	m := profile.toSRGB
+	encode := func(linear float64) uint8 {
+		// NaN included
+		if !(linear > 0) {
+			return 0
+		}
+		if linear >= 1 {
+			return 255
+		}
+		return srgbValues[int(linear*4095+0.5)]
+	}
+	for y := converted.Rect.Min.Y; y < converted.Rect.Max.Y; y++ {
+		row := converted.Pix[converted.PixOffset(converted.Rect.Min.X, y):]
+		for i := 0; i < 4*converted.Rect.Dx(); i += 4 {
+			r, g, b := profile.linear[0][row[i]], profile.linear[1][row[i+1]], profile.linear[2][row[i+2]]
+			row[i] = encode(m[0][0]*r + m[0][1]*g + m[0][2]*b)
+			row[i+1] = encode(m[1][0]*r + m[1][1]*g + m[1][2]*b)
+			row[i+2] = encode(m[2][0]*r + m[2][1]*g + m[2][2]*b)
+		}
+	}
+	return converted
+}
+
+// Color profile embedded in an image, nil when it has none, when it is
+// already sRGB, or when it cannot be converted.
+func readProfile(r io.Reader, format string) *colorProfile {
+	var profile *colorProfile
+	switch format {
+	case "png":
+		profile = readPNGProfile(r)
+	case "jpeg":
+		profile = readJPEGProfile(r)
+	}
+	if profile == nil || profile.srgb() {
+		return nil
+	}
+	return profile
+}
+
+// From the chunks before the image data: an sRGB chunk says no conversion is
+// needed, an ICC profile in iCCP prevails over the gamma of gAMA, unless it
+// cannot be converted.
+// See https://www.w3.org/TR/png/#11addnlcolinfo
+func readPNGProfile(r io.Reader) *colorProfile {
+	reader := bufio.NewReader(r)
+	signature := make([]byte, 8)
+	if _, err := io.ReadFull(reader, signature); err != nil || string(signature) != "\x89PNG\r\n\x1a\n" {
+		return nil
+	}
+	var gamma *colorProfile
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return gamma
+		}
+		length, kind := binary.BigEndian.Uint32(header), string(header[4:])
+		if kind == "IDAT" || length > 1<<24 {
+			return gamma
+		}
+		chunk := make([]byte, length+4)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return gamma
+		}
+		chunk = chunk[:length]
+		switch kind {
+		case "sRGB":
+			return nil
+		case "iCCP":
+			// Profile name, compression method, then the zlib stream
+			nameEnd := bytes.IndexByte(chunk, 0)
+			if nameEnd < 0 || nameEnd+2 > len(chunk) {
+				continue
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(chunk[nameEnd+2:]))
+			if err != nil {
+				continue
+			}
+			data, err := io.ReadAll(zr)
+			if err != nil {
+				continue
+			}
+			if profile, err := parseICC(data); err == nil {
+				return profile
+			}
+		case "gAMA":
+			if length != 4 {
+				continue
+			}
+			// The usual 1/2.2 is written by tools meaning sRGB
+			if value := binary.BigEndian.Uint32(chunk); value > 0 && (value < 44500 || value > 46500) {
+				gamma = gammaProfile(float64(value) / 100000)
+			}
+		}
+	}
+}
+
+// From the ICC profile of a JPEG image, split over numbered APP2 segments.
+func readJPEGProfile(r io.Reader) *colorProfile {
+	reader := bufio.NewReader(r)
+	marker := make([]byte, 4)
+	if _, err := io.ReadFull(reader, marker[:2]); err != nil || marker[0] != 0xff || marker[1] != 0xd8 {
+		return nil
+	}
+	parts := map[byte][]byte{}
+	for {
+		if _, err := io.ReadFull(reader, marker); err != nil || marker[0] != 0xff || marker[1] == 0xda {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if length < 0 {
+			break
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(reader, segment); err != nil {
+			break
+		}
+		if marker[1] == 0xe2 && len(segment) > 14 && string(segment[:12]) == "ICC_PROFILE\x00" {
+			parts[segment[12]] = segment[14:]
+		}
+	}
+	data := []byte{}
+	for number := byte(1); parts[number] != nil; number++ {
+		data = append(data, parts[number]...)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	profile, err := parseICC(data)
+	if err != nil {
+		return nil
+	}
+	return profile
+}
+
+var errICCProfile = errors.New("unsupported ICC profile")
+
+// Parse an RGB matrix/TRC ICC profile, as cameras, editors and screens
+// write: a tone curve and the XYZ coordinates of each primary. Profiles made
+// of lookup tables are not supported.
+// See https://www.color.org/specification/ICC.1-2022-05.pdf
+func parseICC(data []byte) (*colorProfile, error) {
+	if len(data) < 132 || string(data[16:20]) != "RGB " || string(data[20:24]) != "XYZ " {
+		return nil, errICCProfile
+	}
+	tags := map[string][]byte{}
+	count := int(binary.BigEndian.Uint32(data[128:]))
+	for i := 0; i < count && 132+12*(i+1) <= len(data); i++ {
+		entry := data[132+12*i:]
+		offset, size := binary.BigEndian.Uint32(entry[4:]), binary.BigEndian.Uint32(entry[8:])
+		if uint64(offset)+uint64(size) <= uint64(len(data)) {
+			tags[string(entry[:4])] = data[offset : offset+size]
+		}
+	}
+
+	profile := &colorProfile{}
+	var primaries [3][3]float64
+	for c, name := range []string{"r", "g", "b"} {
+		xyz := tags[name+"XYZ"]
+		if len(xyz) < 20 || string(xyz[:4]) != "XYZ " {
+			return nil, errICCProfile
+		}
+		for i := range primaries {
+			primaries[i][c] = float64(int32(binary.BigEndian.Uint32(xyz[8+4*i:]))) / 65536
+		}
+		curve, err := parseICCCurve(tags[name+"TRC"])
+		if err != nil {
+			return nil, err
+		}
+		for v := range profile.linear[c] {
+			profile.linear[c][v] = curve(float64(v) / 255)
+		}
+	}
+	for i := range profile.toSRGB {
+		for j := range profile.toSRGB[i] {
+			for k := range primaries {
+				profile.toSRGB[i][j] += xyzD50ToSRGB[i][k] * primaries[k][j]
+			}
+		}
+	}
+	return profile, nil
+}
+
+// Tone curve of a curv or para tag, from encoded values to linear light.
+// Malformed parameters can make it give no number, as for the power of a
+// negative value: such curves are refused.
+func parseICCCurve(tag []byte) (func(float64) float64, error) {
+	curve, err := readICCCurve(tag)
+	if err != nil {
+		return nil, err
+	}
+	for v := 0; v < 256; v++ {
+		if linear := curve(float64(v) / 255); math.IsNaN(linear) || math.IsInf(linear, 0) {
+			return nil, errICCProfile
+		}
+	}
+	return curve, nil
+}
+
+func readICCCurve(tag []byte) (func(float64) float64, error) {
+	if len(tag) < 12 {
+		return nil, errICCProfile
+	}
+	switch string(tag[:4]) {
+	case "curv":
+		count := int(binary.BigEndian.Uint32(tag[8:]))
+		if len(tag) < 12+2*count {
+			return nil, errICCProfile
+		}
+		switch count {
+		case 0:
+			return func(x float64) float64 { return x }, nil
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, nil
+		}
+		table := make([]float64, count)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+		}
+		return func(x float64) float64 {
+			position := x * float64(count-1)
+			i := int(position)
+			if i >= count-1 {
+				return table[count-1]
+			}
+			return table[i] + (table[i+1]-table[i])*(position-float64(i))
+		}, nil
+	case "para":
+		function := binary.BigEndian.Uint16(tag[8:])
+		paramCounts := []int{1, 3, 4, 5, 7}
+		if int(function) >= len(paramCounts) || len(tag) < 12+4*paramCounts[function] {
+			return nil, errICCProfile
+		}
+		// g, a, b, c, d, e, f, as the specification names them
+		p := [7]float64{1, 1}
+		for i := 0; i < paramCounts[function]; i++ {
+			p[i] = float64(int32(binary.BigEndian.Uint32(tag[12+4*i:]))) / 65536
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		return func(x float64) float64 {
+			switch function {
+			case 0:
+				return math.Pow(x, g)
+			case 1:
+				if x < -b/a {
+					return 0
+				}
+				return math.Pow(a*x+b, g)
+			case 2:
+				if x < -b/a {
+					return c
+				}
+				return math.Pow(a*x+b, g) + c
+			case 3:
+				if x < d {
+					return c * x
+				}
+				return math.Pow(a*x+b, g)
+			default:
+				if x < d {
+					return c*x + f
+				}
+				return math.Pow(a*x+b, g) + e
+			}
+		}, nil
+	}
+	return nil, errICCProfile
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// Images may also be given inline as base64 data URIs, as in
+// data:image/png;base64,iVBORw0KGgo... for scripts that would rather not
+// write a file. See https://www.rfc-editor.org/rfc/rfc2397
+
+func isDataURI(path string) bool {
+	return strings.HasPrefix(path, "data:")
+}
+
+// Format names by MIME subtype, where they differ.
+var mimeFormats = map[string]string{"jpg": "jpeg", "tif": "tiff", "vnd.microsoft.icon": "ico"}
+
+// Decode the content of a data URI, checking that its type is an image
+// format this build supports. The content itself tells its format apart when
+// decoding, as for files without a known extension.
+func readDataURI(uri string, transforms []string) (imgContext, error) {
+	header, payload, found := strings.Cut(strings.TrimPrefix(uri, "data:"), ",")
+	if !found {
+		return imgContext{}, fmt.Errorf("invalid data URI, expected data:image/type;base64,content")
+	}
+	params := strings.Split(header, ";")
+	mimeType := strings.ToLower(params[0])
+	if params[len(params)-1] != "base64" {
+		return imgContext{}, fmt.Errorf("data URI of %s is not base64 encoded", mimeType)
+	}
+	if !strings.HasPrefix(mimeType, "image/") {
+		return imgContext{}, fmt.Errorf("data URI of %s is not an image", mimeType)
+	}
+	format := strings.TrimPrefix(strings.TrimPrefix(mimeType, "image/"), "x-")
+	if mimeFormat, ok := mimeFormats[format]; ok {
+		format = mimeFormat
+	}
+	if _, ok := decoders[format]; !ok {
+		return imgContext{}, fmt.Errorf("data URI of %s: %s images are not supported by this build", mimeType, format)
+	}
+	// Line breaks are common when the URI comes from a file or the environment
+	content, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(payload), ""))
+	if err != nil {
+		return imgContext{}, fmt.Errorf("data URI of %s: %v", mimeType, err)
+	}
+	return imgContext{path: "data:" + mimeType, transforms: transforms, weight: 1, data: content}, nil
+}
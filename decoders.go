@@ -0,0 +1,42 @@
+package main
+
+import (
+	"image"
+	"io"
+	"time"
+)
+
+// Decoders are compiled in depending on build tags, for instance
+// `go build -tags "png jpeg"` only supports PNG and JPEG images.
+// Without any format tag, every decoder is included.
+// Note that the imaging package links the standard library decoders regardless.
+type imageDecoder struct {
+	// Animated images yield several frames along with their display durations.
+	// Frames returned with an error are what could be decoded of a damaged file.
+	decode       func(io.Reader) ([]image.Image, []time.Duration, error)
+	decodeConfig func(io.Reader) (image.Config, error)
+}
+
+// Decoders by format name, as reported by image.DecodeConfig.
+var decoders = map[string]imageDecoder{}
+
+// Format names by file extension.
+var formatExtensions = map[string]string{}
+
+func registerDecoder(format string, extensions []string, decoder imageDecoder) {
+	decoders[format] = decoder
+	for _, extension := range extensions {
+		formatExtensions[extension] = format
+	}
+}
+
+func singleFrame(decode func(io.Reader) (image.Image, error)) func(io.Reader) ([]image.Image, []time.Duration, error) {
+	return func(r io.Reader) ([]image.Image, []time.Duration, error) {
+		img, err := decode(r)
+		if img == nil {
+			return nil, nil, err
+		}
+		// Possibly a partial image along with the error
+		return []image.Image{img}, []time.Duration{0}, err
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+var displayBackends = map[string]bool{
+	"fbdev": true,
+	"drm":   true,
+}
+
+// Where images are shown: a framebuffer device, or a DRM card on kernels
+// moving away from framebuffer devices. Both describe their screen with
+// fb_var_screeninfo and get drawn to through a memory mapping, so the
+// rendering is the same whatever the backend.
+type display interface {
+	// Map the memory shown on screen, returning its visible part along with
+	// the whole mapping to unmap later.
+	mapScreen(screeninfo fb_var_screeninfo, format pixelFormat) (screenBuffer, []byte, error)
+	// Set the colors of a pseudocolor screen, see palette.go
+	loadPalette(colors []color.NRGBA) error
+	// Whether the device is still the one opened, see watchdog.go
+	valid() bool
+	// Push what was written to the mapped pixels out to the screen, for
+	// drivers that do not notice by themselves, see --sync
+	sync(mappedPixels []byte) error
+	// Leave the device as it was found.
+	close()
+}
+
+// Open the display chosen with --backend, filling in its screen information.
+func openDisplay(args args, screeninfo *fb_var_screeninfo) (display, error) {
+	if args.Backend == "drm" {
+		card, err := openDRM(args.DevicePath, screeninfo, time.Duration(args.WaitForFb)*time.Second, args.Verbose)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errDevice, err)
+		}
+		return card, nil
+	}
+	fbF, original, err := openScreen(args, screeninfo)
+	if err != nil {
+		return nil, err
+	}
+	return &fbDisplay{
+		fbF:        fbF,
+		devicePath: args.DevicePath,
+		query:      args.Geometry == nil,
+		rotated:    args.RotateScreen != 0,
+		original:   original,
+		headerSize: args.FbOffset,
+	}, nil
+}
+
+// A framebuffer device, as in /dev/fb0.
+type fbDisplay struct {
+	fbF        *os.File
+	devicePath string
+	// Whether the driver gets asked about the screen, see --geometry
+	query bool
+	// Screen information to restore when rotated with --rotatescreen
+	rotated  bool
+	original fb_var_screeninfo
+	// Colors to restore when the palette got changed
+	colormap []color.NRGBA
+	// Bytes reserved before the pixels, see --fboffset
+	headerSize int
+}
+
+func (fb *fbDisplay) mapScreen(screeninfo fb_var_screeninfo, format pixelFormat) (screenBuffer, []byte, error) {
+	return mapScreen(fb.fbF, screeninfo, format, fb.headerSize)
+}
+
+func (fb *fbDisplay) loadPalette(colors []color.NRGBA) error {
+	if fb.colormap == nil {
+		colormap, err := getColormap(fb.fbF)
+		if err != nil {
+			return err
+		}
+		fb.colormap = colormap
+	}
+	return putColormap(fb.fbF, colors)
+}
+
+func (fb *fbDisplay) valid() bool {
+	return deviceValid(fb.fbF, fb.devicePath, fb.query)
+}
+
+// Write back the CPU cache, then ask the driver to refresh: deferred I/O
+// drivers, as fbtft for SPI panels or udlfb for DisplayLink adapters, update
+// the screen on fsync. Waiting for the vertical blank lets drivers that
+// refresh on it catch up. Drivers that need none of this refuse the requests.
+func (fb *fbDisplay) sync(mappedPixels []byte) error {
+	if err := unix.Msync(mappedPixels, unix.MS_SYNC); err != nil {
+		return err
+	}
+	if err := fb.fbF.Sync(); err != nil && !unsupportedSync(err) {
+		return err
+	}
+	var crtc uint32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fb.fbF.Fd(), FBIO_WAITFORVSYNC, uintptr(unsafe.Pointer(&crtc)))
+	if errno != 0 && !unsupportedSync(errno) {
+		return errno
+	}
+	return nil
+}
+
+// Whether a driver refused a sync request as having nothing to do.
+func unsupportedSync(err error) bool {
+	return errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOTTY) ||
+		errors.Is(err, syscall.ENOSYS) || errors.Is(err, syscall.EOPNOTSUPP)
+}
+
+func (fb *fbDisplay) close() {
+	if fb.rotated {
+		// The console may have been switched away and back meanwhile
+		putScreenInfo(fb.fbF, &fb.original, true)
+	}
+	if fb.colormap != nil {
+		putColormap(fb.fbF, fb.colormap)
+	}
+	fb.fbF.Close()
+}
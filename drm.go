@@ -0,0 +1,370 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Kernel mode setting through a DRM card, as in /dev/dri/card0: a "dumb"
+// buffer, plain memory for the CPU to draw to, is shown on the first
+// connected output in its preferred mode.
+// See include/uapi/drm/drm.h and drm_mode.h in the kernel sources.
+
+type drm_mode_card_res struct {
+	fb_id_ptr        uint64
+	crtc_id_ptr      uint64
+	connector_id_ptr uint64
+	encoder_id_ptr   uint64
+	count_fbs        uint32
+	count_crtcs      uint32
+	count_connectors uint32
+	count_encoders   uint32
+	min_width        uint32
+	max_width        uint32
+	min_height       uint32
+	max_height       uint32
+}
+
+type drm_mode_modeinfo struct {
+	clock       uint32
+	hdisplay    uint16
+	hsync_start uint16
+	hsync_end   uint16
+	htotal      uint16
+	hskew       uint16
+	vdisplay    uint16
+	vsync_start uint16
+	vsync_end   uint16
+	vtotal      uint16
+	vscan       uint16
+	vrefresh    uint32
+	flags       uint32
+	mode_type   uint32
+	name        [32]byte
+}
+
+type drm_mode_get_connector struct {
+	encoders_ptr      uint64
+	modes_ptr         uint64
+	props_ptr         uint64
+	prop_values_ptr   uint64
+	count_modes       uint32
+	count_props       uint32
+	count_encoders    uint32
+	encoder_id        uint32
+	connector_id      uint32
+	connector_type    uint32
+	connector_type_id uint32
+	connection        uint32
+	mm_width          uint32
+	mm_height         uint32
+	subpixel          uint32
+	pad               uint32
+}
+
+type drm_mode_get_encoder struct {
+	encoder_id      uint32
+	encoder_type    uint32
+	crtc_id         uint32
+	possible_crtcs  uint32
+	possible_clones uint32
+}
+
+type drm_mode_crtc struct {
+	set_connectors_ptr uint64
+	count_connectors   uint32
+	crtc_id            uint32
+	fb_id              uint32
+	x                  uint32
+	y                  uint32
+	gamma_size         uint32
+	mode_valid         uint32
+	mode               drm_mode_modeinfo
+}
+
+type drm_mode_fb_cmd struct {
+	fb_id  uint32
+	width  uint32
+	height uint32
+	pitch  uint32
+	bpp    uint32
+	depth  uint32
+	handle uint32
+}
+
+type drm_mode_create_dumb struct {
+	height uint32
+	width  uint32
+	bpp    uint32
+	flags  uint32
+	handle uint32
+	pitch  uint32
+	size   uint64
+}
+
+type drm_mode_map_dumb struct {
+	handle uint32
+	pad    uint32
+	offset uint64
+}
+
+type drm_mode_destroy_dumb struct {
+	handle uint32
+}
+
+type drm_mode_fb_dirty_cmd struct {
+	fb_id     uint32
+	flags     uint32
+	color     uint32
+	num_clips uint32
+	clips_ptr uint64
+}
+
+// _IOWR('d', nr, type): read-write requests carry the size of their argument.
+const drmIOWR = 3<<30 | 'd'<<8
+
+const DRM_IOCTL_MODE_GETRESOURCES = drmIOWR | unsafe.Sizeof(drm_mode_card_res{})<<16 | 0xA0
+const DRM_IOCTL_MODE_GETCRTC = drmIOWR | unsafe.Sizeof(drm_mode_crtc{})<<16 | 0xA1
+const DRM_IOCTL_MODE_SETCRTC = drmIOWR | unsafe.Sizeof(drm_mode_crtc{})<<16 | 0xA2
+const DRM_IOCTL_MODE_GETENCODER = drmIOWR | unsafe.Sizeof(drm_mode_get_encoder{})<<16 | 0xA6
+const DRM_IOCTL_MODE_GETCONNECTOR = drmIOWR | unsafe.Sizeof(drm_mode_get_connector{})<<16 | 0xA7
+const DRM_IOCTL_MODE_ADDFB = drmIOWR | unsafe.Sizeof(drm_mode_fb_cmd{})<<16 | 0xAE
+const DRM_IOCTL_MODE_RMFB = drmIOWR | unsafe.Sizeof(uint32(0))<<16 | 0xAF
+const DRM_IOCTL_MODE_CREATE_DUMB = drmIOWR | unsafe.Sizeof(drm_mode_create_dumb{})<<16 | 0xB2
+const DRM_IOCTL_MODE_MAP_DUMB = drmIOWR | unsafe.Sizeof(drm_mode_map_dumb{})<<16 | 0xB3
+const DRM_IOCTL_MODE_DESTROY_DUMB = drmIOWR | unsafe.Sizeof(drm_mode_destroy_dumb{})<<16 | 0xB4
+const DRM_IOCTL_MODE_DIRTYFB = drmIOWR | unsafe.Sizeof(drm_mode_fb_dirty_cmd{})<<16 | 0xB1
+
+const DRM_MODE_CONNECTED = 1
+const DRM_MODE_TYPE_PREFERRED = 1 << 3
+
+type drmDisplay struct {
+	cardF       *os.File
+	devicePath  string
+	connectorId uint32
+	mode        drm_mode_modeinfo
+	// Dumb buffer and the framebuffer object showing it, 0 until created
+	handle uint32
+	pitch  uint32
+	size   uint64
+	fbId   uint32
+	// What the output showed before, put back on close
+	saved drm_mode_crtc
+}
+
+// Open a DRM card and show a dumb buffer on its first connected output,
+// describing it with framebuffer screen information.
+func openDRM(devicePath string, screeninfo *fb_var_screeninfo, wait time.Duration, verbose bool) (*drmDisplay, error) {
+	cardF, err := openFramebuffer(devicePath, nil, wait, verbose)
+	if err != nil {
+		return nil, err
+	}
+	card := &drmDisplay{cardF: cardF, devicePath: devicePath}
+	err = card.setup(screeninfo, verbose)
+	if err != nil {
+		card.close()
+		return nil, fmt.Errorf("%s: %v", devicePath, err)
+	}
+	return card, nil
+}
+
+func (card *drmDisplay) ioctl(request uintptr, arg unsafe.Pointer) error {
+	for {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, card.cardF.Fd(), request, uintptr(arg))
+		if errno == syscall.EINTR || errno == syscall.EAGAIN {
+			continue
+		}
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+}
+
+func (card *drmDisplay) setup(screeninfo *fb_var_screeninfo, verbose bool) error {
+	// Once for the counts, then again for the ids
+	resources := drm_mode_card_res{}
+	if err := card.ioctl(DRM_IOCTL_MODE_GETRESOURCES, unsafe.Pointer(&resources)); err != nil {
+		return fmt.Errorf("no mode setting support: %v", err)
+	}
+	if resources.count_connectors == 0 || resources.count_crtcs == 0 {
+		return errors.New("no output")
+	}
+	connectorIds := make([]uint32, resources.count_connectors)
+	crtcIds := make([]uint32, resources.count_crtcs)
+	resources = drm_mode_card_res{
+		connector_id_ptr: uint64(uintptr(unsafe.Pointer(&connectorIds[0]))),
+		count_connectors: uint32(len(connectorIds)),
+		crtc_id_ptr:      uint64(uintptr(unsafe.Pointer(&crtcIds[0]))),
+		count_crtcs:      uint32(len(crtcIds)),
+	}
+	if err := card.ioctl(DRM_IOCTL_MODE_GETRESOURCES, unsafe.Pointer(&resources)); err != nil {
+		return err
+	}
+
+	var connector drm_mode_get_connector
+	for _, connectorId := range connectorIds {
+		connector = drm_mode_get_connector{connector_id: connectorId}
+		if card.ioctl(DRM_IOCTL_MODE_GETCONNECTOR, unsafe.Pointer(&connector)) != nil ||
+			connector.connection != DRM_MODE_CONNECTED || connector.count_modes == 0 {
+			continue
+		}
+		modes := make([]drm_mode_modeinfo, connector.count_modes)
+		connector = drm_mode_get_connector{
+			connector_id: connectorId,
+			modes_ptr:    uint64(uintptr(unsafe.Pointer(&modes[0]))),
+			count_modes:  uint32(len(modes)),
+		}
+		// Modes are only filled in when there is room for all of them
+		if card.ioctl(DRM_IOCTL_MODE_GETCONNECTOR, unsafe.Pointer(&connector)) != nil || int(connector.count_modes) > len(modes) {
+			continue
+		}
+		card.connectorId = connectorId
+		card.mode = modes[0]
+		for _, mode := range modes {
+			if mode.mode_type&DRM_MODE_TYPE_PREFERRED != 0 {
+				card.mode = mode
+				break
+			}
+		}
+		break
+	}
+	if card.connectorId == 0 {
+		return errors.New("no connected output")
+	}
+
+	// Keep the controller already driving the output, if any
+	crtcId := uint32(0)
+	possibleCrtcs := ^uint32(0)
+	if connector.encoder_id != 0 {
+		encoder := drm_mode_get_encoder{encoder_id: connector.encoder_id}
+		if card.ioctl(DRM_IOCTL_MODE_GETENCODER, unsafe.Pointer(&encoder)) == nil {
+			crtcId = encoder.crtc_id
+			possibleCrtcs = encoder.possible_crtcs
+		}
+	}
+	for i := 0; crtcId == 0 && i < len(crtcIds); i++ {
+		if possibleCrtcs&(1<<i) != 0 {
+			crtcId = crtcIds[i]
+		}
+	}
+
+	dumb := drm_mode_create_dumb{width: uint32(card.mode.hdisplay), height: uint32(card.mode.vdisplay), bpp: 32}
+	if err := card.ioctl(DRM_IOCTL_MODE_CREATE_DUMB, unsafe.Pointer(&dumb)); err != nil {
+		return fmt.Errorf("cannot allocate a buffer: %v", err)
+	}
+	card.handle, card.pitch, card.size = dumb.handle, dumb.pitch, dumb.size
+	fbCmd := drm_mode_fb_cmd{width: dumb.width, height: dumb.height, pitch: dumb.pitch, bpp: 32, depth: 24, handle: dumb.handle}
+	if err := card.ioctl(DRM_IOCTL_MODE_ADDFB, unsafe.Pointer(&fbCmd)); err != nil {
+		return fmt.Errorf("cannot add a framebuffer: %v", err)
+	}
+	card.fbId = fbCmd.fb_id
+
+	card.saved = drm_mode_crtc{crtc_id: crtcId}
+	if card.ioctl(DRM_IOCTL_MODE_GETCRTC, unsafe.Pointer(&card.saved)) != nil {
+		card.saved = drm_mode_crtc{}
+	}
+	crtc := drm_mode_crtc{
+		set_connectors_ptr: uint64(uintptr(unsafe.Pointer(&card.connectorId))),
+		count_connectors:   1,
+		crtc_id:            crtcId,
+		fb_id:              card.fbId,
+		mode_valid:         1,
+		mode:               card.mode,
+	}
+	if err := card.ioctl(DRM_IOCTL_MODE_SETCRTC, unsafe.Pointer(&crtc)); err != nil {
+		// Typically another program, such as a display server, is in control
+		card.saved = drm_mode_crtc{}
+		return fmt.Errorf("cannot show the buffer: %v", err)
+	}
+	if verbose {
+		fmt.Fprintf(os.Stderr, "DRM output %d showing %dx%d@%d on controller %d\n",
+			card.connectorId, card.mode.hdisplay, card.mode.vdisplay, card.mode.vrefresh, crtcId)
+	}
+
+	// XRGB8888, the layout dumb buffers are always given
+	*screeninfo = fb_var_screeninfo{}
+	screeninfo.xres = uint32(card.mode.hdisplay)
+	screeninfo.yres = uint32(card.mode.vdisplay)
+	screeninfo.xres_virtual = screeninfo.xres
+	screeninfo.yres_virtual = screeninfo.yres
+	screeninfo.bits_per_pixel = 32
+	screeninfo.red = fb_bitfield{16, 8, 0}
+	screeninfo.green = fb_bitfield{8, 8, 0}
+	screeninfo.blue = fb_bitfield{0, 8, 0}
+	screeninfo.width = connector.mm_width
+	screeninfo.height = connector.mm_height
+	return nil
+}
+
+func (card *drmDisplay) mapScreen(screeninfo fb_var_screeninfo, format pixelFormat) (screenBuffer, []byte, error) {
+	if format.bytes != 4 {
+		return screenBuffer{}, nil, errors.New("DRM buffers only hold 32-bit pixels")
+	}
+	mapDumb := drm_mode_map_dumb{handle: card.handle}
+	if err := card.ioctl(DRM_IOCTL_MODE_MAP_DUMB, unsafe.Pointer(&mapDumb)); err != nil {
+		return screenBuffer{}, nil, err
+	}
+	mappedPixels, err := syscall.Mmap(int(card.cardF.Fd()), int64(mapDumb.offset), int(card.size),
+		syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_SHARED)
+	if err != nil {
+		return screenBuffer{}, nil, err
+	}
+	return screenBuffer{
+		pixels: mappedPixels,
+		width:  int(screeninfo.xres),
+		height: int(screeninfo.yres),
+		stride: int(card.pitch) / format.bytes,
+		format: format,
+	}, mappedPixels, nil
+}
+
+// Never called as the buffers are 32-bit.
+func (card *drmDisplay) loadPalette(colors []color.NRGBA) error {
+	return errors.New("DRM buffers have no palette")
+}
+
+// Drivers sending frames over a bus, as udl for DisplayLink adapters, gud or
+// the SPI panel drivers, only update the screen when told which framebuffer
+// changed. Without clips, the whole of it did.
+func (card *drmDisplay) sync(mappedPixels []byte) error {
+	if err := unix.Msync(mappedPixels, unix.MS_SYNC); err != nil {
+		return err
+	}
+	dirty := drm_mode_fb_dirty_cmd{fb_id: card.fbId}
+	if err := card.ioctl(DRM_IOCTL_MODE_DIRTYFB, unsafe.Pointer(&dirty)); err != nil && !unsupportedSync(err) {
+		return err
+	}
+	return nil
+}
+
+func (card *drmDisplay) valid() bool {
+	return deviceValid(card.cardF, card.devicePath, false)
+}
+
+func (card *drmDisplay) close() {
+	if card.saved.crtc_id != 0 {
+		// A controller found without a mode was off, and gets turned off again
+		if card.saved.mode_valid != 0 {
+			card.saved.set_connectors_ptr = uint64(uintptr(unsafe.Pointer(&card.connectorId)))
+			card.saved.count_connectors = 1
+		}
+		card.ioctl(DRM_IOCTL_MODE_SETCRTC, unsafe.Pointer(&card.saved))
+	}
+	if card.fbId != 0 {
+		card.ioctl(DRM_IOCTL_MODE_RMFB, unsafe.Pointer(&card.fbId))
+	}
+	if card.handle != 0 {
+		destroy := drm_mode_destroy_dumb{handle: card.handle}
+		card.ioctl(DRM_IOCTL_MODE_DESTROY_DUMB, unsafe.Pointer(&destroy))
+	}
+	card.cardF.Close()
+}
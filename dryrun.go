@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"os"
+)
+
+// Screen size assumed by --dryrun without --geometry.
+const dryRunWidth = 1920
+const dryRunHeight = 1080
+
+var knownTransforms = map[string]bool{
+	"stretch": true, "fit": true, "hfit": true, "vfit": true, "autofit": true, "crop-to-aspect": true, "center": true,
+	"rotate90": true, "rotate180": true, "rotate270": true,
+}
+
+// Load every image as a normal run would and report where it would be shown,
+// without touching the framebuffer.
+func dryRun(sources []imgContext, args args) error {
+	if len(sources) == 0 {
+		return fmt.Errorf("%w: no image to check", errUsage)
+	}
+	screen_width, screen_height := dryRunWidth, dryRunHeight
+	if args.Geometry != nil {
+		screen_width, screen_height = args.Geometry.width, args.Geometry.height
+	}
+	if args.Viewport != nil {
+		screen_width = image.Rectangle(*args.Viewport).Dx()
+		screen_height = image.Rectangle(*args.Viewport).Dy()
+	}
+	// Not worth drawing: placement does not depend on them
+	args.Checkerboard = 0
+	args.Gradient = nil
+
+	failed := 0
+	for _, source := range sources {
+		unknown := false
+		for _, transform := range source.transforms {
+			if !knownTransforms[transform] {
+				fmt.Fprintf(os.Stderr, "%s: unknown transform: %s\n", source.path, transform)
+				unknown = true
+			}
+		}
+		imageContext, err := loadImage(source, args, screen_width, screen_height)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if err != nil || unknown {
+			failed++
+			continue
+		}
+
+		fmt.Printf("%s: %dx%d shown at %d,%d on a %dx%d screen",
+			imageContext.path, imageContext.image_width, imageContext.image_height,
+			imageContext.screen_xoffset, imageContext.screen_yoffset, screen_width, screen_height)
+		if imageContext.image_xoffset != 0 || imageContext.image_yoffset != 0 {
+			fmt.Printf(", cropped from %d,%d", imageContext.image_xoffset, imageContext.image_yoffset)
+		}
+		if len(imageContext.frames) > 1 {
+			fmt.Printf(", %d frames", len(imageContext.frames))
+		}
+		fmt.Println()
+	}
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d images cannot be shown", errInput, failed, len(sources))
+	}
+	return nil
+}
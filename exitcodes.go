@@ -0,0 +1,36 @@
+package main
+
+import "errors"
+
+// Failure classes, so that supervisors can tell a missing device from bad input.
+var (
+	errDevice      = errors.New("framebuffer unavailable")
+	errPixelFormat = errors.New("unsupported pixel format")
+	errInput       = errors.New("cannot load images")
+	errUsage       = errors.New("invalid option")
+)
+
+// Exit codes, documented in the README. go-arg exits with 255 on bad flags.
+const (
+	exitFailure     = 1
+	exitUsage       = 2
+	exitDevice      = 3
+	exitPixelFormat = 4
+	exitInput       = 5
+)
+
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, errUsage):
+		return exitUsage
+	case errors.Is(err, errDevice):
+		return exitDevice
+	case errors.Is(err, errPixelFormat):
+		return exitPixelFormat
+	case errors.Is(err, errInput):
+		return exitInput
+	}
+	return exitFailure
+}
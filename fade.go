@@ -0,0 +1,48 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"time"
+)
+
+// Time between the steps of --fadein.
+const fadeStep = 40 * time.Millisecond
+
+// Bring what the back buffer holds in the rect onto the screen gradually,
+// blending it over the black of a cleared screen. Stops early, leaving the
+// final frame to the next flush, when skip returns true.
+func fadeIn(back *backBuffer, rect image.Rectangle, duration time.Duration, flush func() error, skip func() bool) error {
+	final := make([]byte, len(back.pixels))
+	copy(final, back.pixels)
+	defer func() {
+		copy(back.pixels, final)
+		back.markDirty(rect)
+	}()
+	region := back.sub(rect)
+	target := captureScreen(region)
+	black := color.NRGBA{0, 0, 0, 255}
+	steps := int(duration / fadeStep)
+	for step := 1; step < steps; step++ {
+		if skip() {
+			return nil
+		}
+		stepStart := time.Now()
+		alpha := uint8(step * 255 / steps)
+		for y := 0; y < region.height; y++ {
+			curPixelBit := region.offset(0, y)
+			for x := 0; x < region.width; x++ {
+				pixColor := target.NRGBAAt(x, y)
+				pixColor.A = alpha
+				region.format.pack(region.pixels[curPixelBit:], region.blend(pixColor, black))
+				curPixelBit += region.format.bytes
+			}
+		}
+		back.markDirty(rect)
+		if err := flush(); err != nil {
+			return err
+		}
+		time.Sleep(fadeStep - time.Since(stepStart))
+	}
+	return nil
+}
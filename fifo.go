@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Watch a named pipe, created if missing, where each line written is the
+// path of an image to show. Paths arriving faster than minInterval are
+// coalesced: only the latest one comes out once the interval is over.
+func watchFifo(path string, minInterval time.Duration, verbose bool) (<-chan string, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := syscall.Mkfifo(path, 0o600); err != nil {
+			return nil, err
+		}
+	}
+	// Also opened for writing, so that reads do not hit the end of file
+	// whenever a writer closes its side
+	fifoF, err := os.OpenFile(path, os.O_RDWR, os.ModeNamedPipe)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := make(chan string)
+	go func() {
+		defer fifoF.Close()
+		scanner := bufio.NewScanner(fifoF)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				lines <- line
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			fmt.Fprintln(os.Stderr, path, ":", err)
+		}
+		close(lines)
+	}()
+
+	pushes := make(chan string, 1)
+	go func() {
+		var latest string
+		var timer <-chan time.Time
+		lastPush := time.Time{}
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					return
+				}
+				if verbose && timer != nil {
+					fmt.Fprintln(os.Stderr, "Skipping", latest, "in favour of", line)
+				}
+				latest = line
+				if timer == nil {
+					timer = time.After(minInterval - time.Since(lastPush))
+				}
+			case <-timer:
+				timer = nil
+				lastPush = time.Now()
+				// Replace a push the render loop has not picked up yet
+				select {
+				case <-pushes:
+				default:
+				}
+				pushes <- latest
+			}
+		}
+	}()
+	return pushes, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Blurring a smaller copy is much faster and looks the same once enlarged.
+const fillBlurScale = 8
+const fillBlurSigma = 20.0 / fillBlurScale
+
+var fillModes = map[string]bool{
+	"none":   true,
+	"blur":   true,
+	"mirror": true,
+}
+
+// Screen-sized image shown around a letterboxed image, nil when the image
+// covers the whole screen or no fill was asked for.
+func fillBackground(mode string, original image.Image, imageContext imgContext, screen_width int, screen_height int) image.Image {
+	if imageContext.screenRect() == image.Rect(0, 0, screen_width, screen_height) {
+		return nil
+	}
+	switch mode {
+	case "blur":
+		small := imaging.Fill(original, screen_width/fillBlurScale+1, screen_height/fillBlurScale+1, imaging.Center, imaging.Linear)
+		return imaging.Resize(imaging.Blur(small, fillBlurSigma), screen_width, screen_height, imaging.Linear)
+	case "mirror":
+		background := image.NewNRGBA(image.Rect(0, 0, screen_width, screen_height))
+		for y := 0; y < screen_height; y++ {
+			imgY := imageContext.image_yoffset + reflectIndex(y-imageContext.screen_yoffset, imageContext.image_height)
+			for x := 0; x < screen_width; x++ {
+				imgX := imageContext.image_xoffset + reflectIndex(x-imageContext.screen_xoffset, imageContext.image_width)
+				background.SetNRGBA(x, y, imageContext.image.At(imgX, imgY).(color.NRGBA))
+			}
+		}
+		return background
+	}
+	return nil
+}
+
+// Index within [0, size) of a position mirrored back and forth across the edges.
+func reflectIndex(i int, size int) int {
+	i %= 2 * size
+	if i < 0 {
+		i += 2 * size
+	}
+	if i >= size {
+		return 2*size - 1 - i
+	}
+	return i
+}
+
+// Light and dark squares, as image viewers show behind transparent images.
+var checkerColors = [2]color.NRGBA{{0xcc, 0xcc, 0xcc, 0xff}, {0x99, 0x99, 0x99, 0xff}}
+
+func checkerboard(squareSize int, screen_width int, screen_height int) image.Image {
+	background := image.NewNRGBA(image.Rect(0, 0, screen_width, screen_height))
+	for y := 0; y < screen_height; y++ {
+		for x := 0; x < screen_width; x++ {
+			background.SetNRGBA(x, y, checkerColors[(x/squareSize+y/squareSize)%2])
+		}
+	}
+	return background
+}
+
+// Colors shading from one to the other behind images with --gradient, given
+// as rrggbb:rrggbb from top to bottom, or from left to right when followed
+// by :h.
+type gradient struct {
+	from       color.NRGBA
+	to         color.NRGBA
+	horizontal bool
+}
+
+func (ramp *gradient) UnmarshalText(text []byte) error {
+	parts := strings.Split(string(text), ":")
+	if len(parts) == 3 && (parts[2] == "h" || parts[2] == "v") {
+		ramp.horizontal = parts[2] == "h"
+		parts = parts[:2]
+	}
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid gradient: %s, expected rrggbb:rrggbb, optionally followed by :h or :v", text)
+	}
+	var err error
+	if ramp.from, err = parseHexColor(parts[0]); err != nil {
+		return err
+	}
+	ramp.to, err = parseHexColor(parts[1])
+	return err
+}
+
+// Render the gradient once at the screen size, a line or column at a time.
+func (ramp gradient) render(screen_width int, screen_height int) image.Image {
+	background := image.NewNRGBA(image.Rect(0, 0, screen_width, screen_height))
+	steps, length := screen_height, screen_width
+	if ramp.horizontal {
+		steps, length = screen_width, screen_height
+	}
+	mix := func(from uint8, to uint8, t float64) uint8 {
+		return uint8(float64(from) + (float64(to)-float64(from))*t + 0.5)
+	}
+	for step := 0; step < steps; step++ {
+		t := 0.0
+		if steps > 1 {
+			t = float64(step) / float64(steps-1)
+		}
+		shade := color.NRGBA{mix(ramp.from.R, ramp.to.R, t), mix(ramp.from.G, ramp.to.G, t), mix(ramp.from.B, ramp.to.B, t), 255}
+		for i := 0; i < length; i++ {
+			if ramp.horizontal {
+				background.SetNRGBA(step, i, shade)
+			} else {
+				background.SetNRGBA(i, step, shade)
+			}
+		}
+	}
+	return background
+}
+
+// Composite a translucent pixel over an opaque one.
+func blendOver(src color.NRGBA, dst color.NRGBA) color.NRGBA {
+	alpha := uint32(src.A)
+	mix := func(s uint8, d uint8) uint8 {
+		return uint8((uint32(s)*alpha + uint32(d)*(255-alpha)) / 255)
+	}
+	return color.NRGBA{R: mix(src.R, dst.R), G: mix(src.G, dst.G), B: mix(src.B, dst.B), A: 255}
+}
+
+// sRGB channel values in linear light, from 0 to 1.
+var linearValues [256]float64
+
+func init() {
+	for i := range linearValues {
+		value := float64(i) / 255
+		if value <= 0.04045 {
+			linearValues[i] = value / 12.92
+		} else {
+			linearValues[i] = math.Pow((value+0.055)/1.055, 2.4)
+		}
+	}
+}
+
+func srgbValue(linear float64) uint8 {
+	if linear <= 0.0031308 {
+		return uint8(linear*12.92*255 + 0.5)
+	}
+	return uint8((1.055*math.Pow(linear, 1/2.4)-0.055)*255 + 0.5)
+}
+
+// Same as blendOver, mixing in linear light: slower, but without the dark
+// fringes sRGB blending leaves around antialiased edges.
+func blendOverLinear(src color.NRGBA, dst color.NRGBA) color.NRGBA {
+	alpha := float64(src.A) / 255
+	mix := func(s uint8, d uint8) uint8 {
+		return srgbValue(linearValues[s]*alpha + linearValues[d]*(1-alpha))
+	}
+	return color.NRGBA{R: mix(src.R, dst.R), G: mix(src.G, dst.G), B: mix(src.B, dst.B), A: 255}
+}
+
+// Composite a translucent pixel over an opaque one, as the screen is set to.
+func (screen screenBuffer) blend(src color.NRGBA, dst color.NRGBA) color.NRGBA {
+	if screen.linear {
+		return blendOverLinear(src, dst)
+	}
+	return blendOver(src, dst)
+}
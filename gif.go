@@ -0,0 +1,60 @@
+//go:build gif || !(png || jpeg || bmp || webp || tiff || qoi || ico)
+
+package main
+
+import (
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+	"time"
+)
+
+// Like browsers, show frames without a delay for 100ms.
+const gifDefaultDelay = 100 * time.Millisecond
+
+func init() {
+	registerDecoder("gif", []string{".gif"}, imageDecoder{decodeGIF, gif.DecodeConfig})
+}
+
+// Decode every frame of a GIF, composited over the canvas.
+func decodeGIF(r io.Reader) ([]image.Image, []time.Duration, error) {
+	anim, err := gif.DecodeAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	canvas := image.NewNRGBA(image.Rect(0, 0, anim.Config.Width, anim.Config.Height))
+	frames := []image.Image{}
+	delays := []time.Duration{}
+	for i, frame := range anim.Image {
+		disposal := byte(0)
+		if i < len(anim.Disposal) {
+			disposal = anim.Disposal[i]
+		}
+		var previous []byte
+		if disposal == gif.DisposalPrevious {
+			previous = make([]byte, len(canvas.Pix))
+			copy(previous, canvas.Pix)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		snapshot := image.NewNRGBA(canvas.Bounds())
+		copy(snapshot.Pix, canvas.Pix)
+		frames = append(frames, snapshot)
+
+		delay := gifDefaultDelay
+		if i < len(anim.Delay) && anim.Delay[i] > 0 {
+			delay = time.Duration(anim.Delay[i]) * 10 * time.Millisecond
+		}
+		delays = append(delays, delay)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			copy(canvas.Pix, previous)
+		}
+	}
+	return frames, delays, nil
+}
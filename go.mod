@@ -6,10 +6,8 @@ require (
 	github.com/alexflint/go-arg v1.4.3
 	github.com/disintegration/imaging v1.6.2
 	github.com/eiannone/keyboard v0.0.0-20220611211555-0d226195f203
+	golang.org/x/image v0.0.0-20191009234506-e7c1f5e7dbb8
 	golang.org/x/sys v0.0.0-20220520151302-bc2c85ada10a
 )
 
-require (
-	github.com/alexflint/go-scalar v1.1.0 // indirect
-	golang.org/x/image v0.0.0-20191009234506-e7c1f5e7dbb8 // indirect
-)
+require github.com/alexflint/go-scalar v1.1.0 // indirect
@@ -0,0 +1,183 @@
+//go:build ico || !(png || jpeg || gif || bmp || webp || tiff || qoi)
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/bmp"
+)
+
+// Icons hold several images, usually of different sizes: we pick the largest one.
+
+const icoMagic = "\x00\x00\x01\x00"
+
+type icoEntry struct {
+	width    int
+	height   int
+	bitCount int
+	size     uint32
+	offset   uint32
+}
+
+func init() {
+	image.RegisterFormat("ico", icoMagic, decodeICO, decodeICOConfig)
+	registerDecoder("ico", []string{".ico"}, imageDecoder{singleFrame(decodeICO), decodeICOConfig})
+}
+
+func readLargestICOEntry(r io.Reader) (icoEntry, error) {
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return icoEntry{}, err
+	}
+	if string(header[:4]) != icoMagic {
+		return icoEntry{}, errors.New("ico: invalid format")
+	}
+	count := int(binary.LittleEndian.Uint16(header[4:]))
+	if count == 0 {
+		return icoEntry{}, errors.New("ico: no image")
+	}
+
+	largest := icoEntry{}
+	directory := make([]byte, 16*count)
+	if _, err := io.ReadFull(r, directory); err != nil {
+		return icoEntry{}, err
+	}
+	for i := 0; i < count; i++ {
+		raw := directory[16*i:]
+		entry := icoEntry{
+			width:    int(raw[0]),
+			height:   int(raw[1]),
+			bitCount: int(binary.LittleEndian.Uint16(raw[6:])),
+			size:     binary.LittleEndian.Uint32(raw[8:]),
+			offset:   binary.LittleEndian.Uint32(raw[12:]),
+		}
+		// 0 stands for 256
+		if entry.width == 0 {
+			entry.width = 256
+		}
+		if entry.height == 0 {
+			entry.height = 256
+		}
+		area, largestArea := entry.width*entry.height, largest.width*largest.height
+		if area > largestArea || (area == largestArea && entry.bitCount > largest.bitCount) {
+			largest = entry
+		}
+	}
+	return largest, nil
+}
+
+// Read an icon, returning the data of its largest image.
+func readLargestICOPayload(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := readLargestICOEntry(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(entry.offset)+uint64(entry.size) > uint64(len(data)) {
+		return nil, errors.New("ico: truncated image")
+	}
+	return data[entry.offset : entry.offset+entry.size], nil
+}
+
+// The size comes from the image itself: the directory's may be wrong, or 0
+// standing for 256 when the image is larger.
+func decodeICOConfig(r io.Reader) (image.Config, error) {
+	payload, err := readLargestICOPayload(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	if bytes.HasPrefix(payload, []byte("\x89PNG")) {
+		return png.DecodeConfig(bytes.NewReader(payload))
+	}
+	if len(payload) < 40 {
+		return image.Config{}, errors.New("ico: truncated bitmap")
+	}
+	width := int32(binary.LittleEndian.Uint32(payload[4:]))
+	height := int32(binary.LittleEndian.Uint32(payload[8:])) / 2
+	if height < 0 {
+		// Stored top-down
+		height = -height
+	}
+	if width < 0 {
+		return image.Config{}, errors.New("ico: invalid bitmap width")
+	}
+	return image.Config{Width: int(width), Height: int(height)}, nil
+}
+
+func decodeICO(r io.Reader) (image.Image, error) {
+	payload, err := readLargestICOPayload(r)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(payload, []byte("\x89PNG")) {
+		return png.Decode(bytes.NewReader(payload))
+	}
+	return decodeICOBitmap(payload)
+}
+
+// Bitmaps are stored without their file header, and with a doubled height
+// accounting for the transparency mask following the pixels.
+func decodeICOBitmap(payload []byte) (image.Image, error) {
+	if len(payload) < 40 {
+		return nil, errors.New("ico: truncated bitmap")
+	}
+	dib := make([]byte, len(payload))
+	copy(dib, payload)
+	headerSize := binary.LittleEndian.Uint32(dib[0:])
+	height := int32(binary.LittleEndian.Uint32(dib[8:]))
+	binary.LittleEndian.PutUint32(dib[8:], uint32(height/2))
+
+	paletteSize := uint32(0)
+	bitCount := binary.LittleEndian.Uint16(dib[14:])
+	if bitCount <= 8 {
+		colors := binary.LittleEndian.Uint32(dib[32:])
+		if colors == 0 {
+			colors = 1 << bitCount
+		}
+		paletteSize = colors * 4
+	}
+
+	file := bytes.Buffer{}
+	file.WriteString("BM")
+	binary.Write(&file, binary.LittleEndian, uint32(14+len(dib)))
+	binary.Write(&file, binary.LittleEndian, uint32(0))
+	binary.Write(&file, binary.LittleEndian, 14+headerSize+paletteSize)
+	file.Write(dib)
+	img, err := bmp.Decode(&file)
+	if err != nil || bitCount == 32 {
+		// 32-bit pixels have alpha of their own
+		return img, err
+	}
+
+	// Otherwise the mask tells transparent pixels with a set bit, on lines
+	// stored bottom-up and padded to 4 bytes, as the pixels are
+	width, maskHeight := img.Bounds().Dx(), img.Bounds().Dy()
+	maskStart := uint64(headerSize) + uint64(paletteSize) + uint64((width*int(bitCount)+31)/32*4*maskHeight)
+	maskStride := (width + 31) / 32 * 4
+	if maskStart+uint64(maskStride*maskHeight) > uint64(len(payload)) {
+		// Some icons leave it out
+		return img, nil
+	}
+	mask := payload[maskStart:]
+	masked := image.NewNRGBA(image.Rect(0, 0, width, maskHeight))
+	draw.Draw(masked, masked.Bounds(), img, img.Bounds().Min, draw.Src)
+	for y := 0; y < maskHeight; y++ {
+		line := mask[(maskHeight-1-y)*maskStride:]
+		for x := 0; x < width; x++ {
+			if line[x/8]&(0x80>>(x%8)) != 0 {
+				masked.Pix[masked.PixOffset(x, y)+3] = 0
+			}
+		}
+	}
+	return masked, nil
+}
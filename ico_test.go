@@ -0,0 +1,72 @@
+//go:build ico || !(png || jpeg || gif || bmp || webp || tiff || qoi)
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// An icon holding a single image, whose directory entry claims a size of
+// width x height.
+func singleICO(width, height byte, payload []byte) []byte {
+	var ico bytes.Buffer
+	ico.WriteString(icoMagic)
+	binary.Write(&ico, binary.LittleEndian, uint16(1))
+	ico.Write([]byte{width, height, 0, 0})
+	binary.Write(&ico, binary.LittleEndian, []uint16{1, 24})
+	binary.Write(&ico, binary.LittleEndian, []uint32{uint32(len(payload)), 6 + 16})
+	ico.Write(payload)
+	return ico.Bytes()
+}
+
+func TestICOConfigFromImage(t *testing.T) {
+	var payload bytes.Buffer
+	if err := png.Encode(&payload, image.NewNRGBA(image.Rect(0, 0, 300, 200))); err != nil {
+		t.Fatal(err)
+	}
+	for _, claimed := range []byte{0, 16} {
+		config, err := decodeICOConfig(bytes.NewReader(singleICO(claimed, claimed, payload.Bytes())))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Width != 300 || config.Height != 200 {
+			t.Errorf("icon claiming %d pixels is %dx%d, want 300x200", claimed, config.Width, config.Height)
+		}
+	}
+}
+
+// A 2x2 24-bit bitmap icon, red, whose AND mask hides its left column.
+func TestICOBitmapMask(t *testing.T) {
+	var payload bytes.Buffer
+	binary.Write(&payload, binary.LittleEndian, []uint32{40, 2, 4})
+	binary.Write(&payload, binary.LittleEndian, []uint16{1, 24})
+	payload.Write(make([]byte, 24))
+	for y := 0; y < 2; y++ {
+		// Blue, green, red, and padding to 4 bytes
+		payload.Write([]byte{0, 0, 255, 0, 0, 255, 0, 0})
+	}
+	for y := 0; y < 2; y++ {
+		payload.Write([]byte{0x80, 0, 0, 0})
+	}
+
+	img, err := decodeICO(bytes.NewReader(singleICO(2, 2, payload.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 2 || img.Bounds().Dy() != 2 {
+		t.Fatalf("decoded to %v, want 2x2", img.Bounds().Size())
+	}
+	for y := 0; y < 2; y++ {
+		if _, _, _, a := img.At(0, y).RGBA(); a != 0 {
+			t.Errorf("masked pixel 0,%d has alpha %d, want 0", y, a)
+		}
+		if got := color.NRGBAModel.Convert(img.At(1, y)); got != (color.NRGBA{255, 0, 0, 255}) {
+			t.Errorf("pixel 1,%d is %v, want opaque red", y, got)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+//go:build jpeg || !(png || gif || bmp || webp || tiff || qoi || ico)
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"strings"
+)
+
+func init() {
+	registerDecoder("jpeg", []string{".jpg", ".jpeg"}, imageDecoder{singleFrame(decodeJPEG), jpeg.DecodeConfig})
+}
+
+// Adobe APP14 segment marking the image data as CMYK, with no color transform.
+var adobeCMYKMarker = []byte{0xff, 0xee, 0, 14, 'A', 'd', 'o', 'b', 'e', 0, 100, 0, 0, 0, 0, 0}
+
+// Decode a JPEG image, turning CMYK ones from print workflows into RGB.
+// Photoshop stores CMYK inverted, 255 meaning no ink, and says so with an
+// Adobe marker, which the standard decoder follows. Other writers leave the
+// marker out and the values as they are, which the standard decoder refuses:
+// such images get decoded as if marked, then inverted back.
+func decodeJPEG(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if _, ok := err.(jpeg.UnsupportedError); ok && strings.Contains(err.Error(), "Adobe APP14") && len(data) > 2 {
+		marked := append(append(append([]byte{}, data[:2]...), adobeCMYKMarker...), data[2:]...)
+		img, err = jpeg.Decode(bytes.NewReader(marked))
+		if cmyk, ok := img.(*image.CMYK); ok {
+			for i := range cmyk.Pix {
+				cmyk.Pix[i] = 255 - cmyk.Pix[i]
+			}
+		}
+	}
+	if cmyk, ok := img.(*image.CMYK); ok {
+		return cmykToNRGBA(cmyk), err
+	}
+	return img, err
+}
+
+// Convert once rather than on each access through transforms.
+func cmykToNRGBA(cmyk *image.CMYK) *image.NRGBA {
+	rgb := image.NewNRGBA(cmyk.Rect)
+	for y := cmyk.Rect.Min.Y; y < cmyk.Rect.Max.Y; y++ {
+		src := cmyk.Pix[cmyk.PixOffset(cmyk.Rect.Min.X, y):]
+		dst := rgb.Pix[rgb.PixOffset(rgb.Rect.Min.X, y):]
+		for i := 0; i < 4*cmyk.Rect.Dx(); i += 4 {
+			dst[i], dst[i+1], dst[i+2] = color.CMYKToRGB(src[i], src[i+1], src[i+2], src[i+3])
+			dst[i+3] = 255
+		}
+	}
+	return rgb
+}
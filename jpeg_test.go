@@ -0,0 +1,87 @@
+//go:build jpeg || !(png || gif || bmp || webp || tiff || qoi || ico)
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"testing"
+)
+
+// From the standard library's test images: a CMYK JPEG written by Photoshop,
+// with its Adobe marker, and the same image decoded to RGB.
+const cmykJPEGPath = "testdata/video-001.cmyk.jpeg"
+const cmykPNGPath = "testdata/video-001.cmyk.png"
+
+func readFixture(t *testing.T, path string) []byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDecodeAdobeCMYKJPEG(t *testing.T) {
+	img, err := decodeJPEG(bytes.NewReader(readFixture(t, cmykJPEGPath)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := img.(*image.NRGBA); !ok {
+		t.Fatalf("decoded as %T, want *image.NRGBA", img)
+	}
+	want, err := png.Decode(bytes.NewReader(readFixture(t, cmykPNGPath)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != want.Bounds() {
+		t.Fatalf("decoded bounds %v, want %v", img.Bounds(), want.Bounds())
+	}
+	for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
+		for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
+			got := img.(*image.NRGBA).NRGBAAt(x, y)
+			wantColor := color.NRGBAModel.Convert(want.At(x, y)).(color.NRGBA)
+			if !nearColor(got, wantColor) || got.A != 255 {
+				t.Fatalf("pixel %d,%d is %v, want %v", x, y, got, wantColor)
+			}
+		}
+	}
+}
+
+// Writers other than Photoshop leave the Adobe marker out and store ink
+// amounts as they are, 255 meaning full ink. Removing the marker from the
+// fixture makes such an image of its inverted values.
+func TestDecodeUnmarkedCMYKJPEG(t *testing.T) {
+	data := readFixture(t, cmykJPEGPath)
+	marker := bytes.Index(data, []byte{0xff, 0xee})
+	if marker < 0 {
+		t.Fatal("no Adobe marker in the fixture")
+	}
+	length := int(data[marker+2])<<8 | int(data[marker+3])
+	unmarked := append(append([]byte{}, data[:marker]...), data[marker+2+length:]...)
+	if _, err := jpeg.Decode(bytes.NewReader(unmarked)); err == nil {
+		t.Fatal("the standard decoder now reads unmarked CMYK JPEGs, decodeJPEG could rely on it")
+	}
+
+	img, err := decodeJPEG(bytes.NewReader(unmarked))
+	if err != nil {
+		t.Fatal(err)
+	}
+	marked, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmyk := marked.(*image.CMYK)
+	for y := cmyk.Rect.Min.Y; y < cmyk.Rect.Max.Y; y++ {
+		for x := cmyk.Rect.Min.X; x < cmyk.Rect.Max.X; x++ {
+			ink := cmyk.CMYKAt(x, y)
+			r, g, b := color.CMYKToRGB(255-ink.C, 255-ink.M, 255-ink.Y, 255-ink.K)
+			if got := img.(*image.NRGBA).NRGBAAt(x, y); got != (color.NRGBA{r, g, b, 255}) {
+				t.Fatalf("pixel %d,%d is %v, want %v", x, y, got, color.NRGBA{r, g, b, 255})
+			}
+		}
+	}
+}
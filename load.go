@@ -0,0 +1,514 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// Decode and transform all images, several at a time, preserving their order.
+// Among several images, those failing to load are skipped unless all of them do.
+func loadImages(sources []imgContext, args args, screen_width int, screen_height int, progress func(loaded int, total int)) ([]imgContext, error) {
+	shareBackground(sources, args, screen_width, screen_height)
+
+	imageContexts := make([]imgContext, len(sources))
+	errs := make([]error, len(sources))
+
+	jobs := make(chan int)
+	done := make(chan int)
+	for worker := 0; worker < runtime.NumCPU(); worker++ {
+		go func() {
+			for i := range jobs {
+				imageContexts[i], errs[i] = loadImage(sources[i], args, screen_width, screen_height)
+				done <- i
+			}
+		}()
+	}
+	go func() {
+		for i := range sources {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+	// Progress is reported from this goroutine only, as images complete
+	for count := 1; count <= len(sources); count++ {
+		<-done
+		if progress != nil {
+			progress(count, len(sources))
+		}
+	}
+
+	loaded := []imgContext{}
+	var lastErr error
+	for i, err := range errs {
+		if err == nil {
+			loaded = append(loaded, imageContexts[i])
+			continue
+		}
+		lastErr = err
+		if args.Verbose && len(sources) > 1 {
+			fmt.Fprintln(os.Stderr, "Skipping", err)
+		}
+	}
+	if len(loaded) == 0 {
+		return nil, lastErr
+	}
+	return loaded, nil
+}
+
+// Give every image the background they all share, if any: the checker pattern,
+// --bgimage or --gradient, made once for all of them.
+func shareBackground(imageContexts []imgContext, args args, screen_width int, screen_height int) {
+	var background image.Image
+	if args.Checkerboard > 0 {
+		background = checkerboard(args.Checkerboard, screen_width, screen_height)
+	}
+	if args.BgImage.image != nil {
+		background = args.BgImage.image
+	}
+	if args.Gradient != nil {
+		background = args.Gradient.render(screen_width, screen_height)
+	}
+	if background == nil {
+		return
+	}
+	for i := range imageContexts {
+		imageContexts[i].background = background
+	}
+}
+
+// Make sure only the images at the given indices are held in memory, decoding
+// them one by one if needed and dropping all others. A background shared by
+// all images, as given by shareBackground, stays.
+func loadOnly(imageContexts []imgContext, indices []int, args args, screen_width int, screen_height int) error {
+	wanted := map[int]bool{}
+	for _, i := range indices {
+		wanted[i] = true
+	}
+	shared := args.Checkerboard > 0 || args.BgImage.image != nil || args.Gradient != nil
+	for i := range imageContexts {
+		if !wanted[i] {
+			if shared && imageContexts[i].unshadowed != nil {
+				// Back to the shared background, without this image's shadow
+				imageContexts[i].background = imageContexts[i].unshadowed
+			} else if !shared {
+				imageContexts[i].background = nil
+			}
+			imageContexts[i].image = nil
+			imageContexts[i].decoded = nil
+			imageContexts[i].frames = nil
+			imageContexts[i].delays = nil
+			imageContexts[i].unshadowed = nil
+		}
+	}
+	for i := range wanted {
+		if imageContexts[i].image == nil {
+			loaded, err := loadImage(imageContexts[i], args, screen_width, screen_height)
+			if err != nil {
+				return err
+			}
+			imageContexts[i] = loaded
+		}
+	}
+	return nil
+}
+
+func loadImage(imageContext imgContext, args args, screen_width int, screen_height int) (imgContext, error) {
+	imageContext, err := decodeImage(imageContext, args)
+	if err != nil {
+		return imageContext, err
+	}
+	err = placeImage(&imageContext, args, screen_width, screen_height)
+	return imageContext, err
+}
+
+// Read an image's frames, as decoded and turned upright, without transforming them.
+func decodeImage(imageContext imgContext, args args) (imgContext, error) {
+	imgPath := imageContext.path
+	if len(imageContext.sequence) > 0 {
+		return decodeSequence(imageContext, args)
+	}
+
+	if info, err := os.Stat(imageContext.filePath()); err == nil {
+		imageContext.modified, imageContext.size = info.ModTime(), info.Size()
+	}
+
+	imgF, err := openImage(imageContext)
+	if err != nil {
+		return imageContext, err
+	}
+	defer imgF.Close()
+
+	format, ok := formatExtensions[strings.ToLower(filepath.Ext(imgPath))]
+	if !ok {
+		// Recognize the format from its content
+		_, format, err = image.DecodeConfig(imgF)
+		if err != nil {
+			return imageContext, fmt.Errorf("%s: %v", imgPath, err)
+		}
+		if _, err = imgF.Seek(0, io.SeekStart); err != nil {
+			return imageContext, err
+		}
+	}
+	decoder, ok := decoders[format]
+	if !ok {
+		return imageContext, fmt.Errorf("%s: %s images are not supported by this build", imgPath, format)
+	}
+
+	if args.MaxPixels > 0 {
+		config, err := decoder.decodeConfig(imgF)
+		if err != nil {
+			return imageContext, err
+		}
+		// In 64 bits, as a crafted header could overflow 32-bit ints past the limit
+		if int64(config.Width)*int64(config.Height) > int64(args.MaxPixels) {
+			return imageContext, fmt.Errorf("%s is %dx%d which exceeds the limit of %d pixels", imgPath, config.Width, config.Height, args.MaxPixels)
+		}
+		if _, err = imgF.Seek(0, io.SeekStart); err != nil {
+			return imageContext, err
+		}
+	}
+
+	decodeStart := time.Now()
+	frames, delays, err := decoder.decode(imgF)
+	if err != nil {
+		if len(frames) == 0 {
+			return imageContext, fmt.Errorf("%s: %v", imgPath, err)
+		}
+		if args.Verbose {
+			fmt.Fprintln(os.Stderr, imgPath, "is damaged, showing what could be decoded:", err)
+		}
+	}
+	if args.Verbose {
+		fmt.Fprintln(os.Stderr, imgPath, "decoded in", time.Since(decodeStart))
+	}
+
+	if args.AutoOrient && format == "jpeg" {
+		// Done first and apart from transforms, which then apply to the upright image
+		if _, err = imgF.Seek(0, io.SeekStart); err != nil {
+			return imageContext, err
+		}
+		orientation := readOrientation(imgF)
+		if args.Verbose && orientation != 1 {
+			fmt.Fprintln(os.Stderr, imgPath, "has EXIF orientation", orientation)
+		}
+		for i := range frames {
+			frames[i] = orient(frames[i], orientation)
+		}
+	}
+	if !args.NoProfile {
+		if _, err = imgF.Seek(0, io.SeekStart); err != nil {
+			return imageContext, err
+		}
+		if profile := readProfile(imgF, format); profile != nil {
+			if args.Verbose {
+				fmt.Fprintln(os.Stderr, imgPath, "has a color profile, converting to sRGB")
+			}
+			for i := range frames {
+				frames[i] = profile.apply(frames[i])
+			}
+		}
+	}
+	imageContext.decoded = frames
+	imageContext.opaque = opaqueFrames(frames)
+	imageContext.format = format
+	imageContext.delays = delays
+	if args.Verbose && len(frames) > 1 {
+		fmt.Fprintln(os.Stderr, "Animation frames:", len(frames))
+	}
+	return imageContext, nil
+}
+
+// Whether no frame has transparency. Types without alpha, as JPEG's YCbCr,
+// tell at once, but NRGBA images get every pixel checked, so this is only
+// done once, when decoding.
+func opaqueFrames(frames []image.Image) bool {
+	for _, frame := range frames {
+		if opaque, ok := frame.(interface{ Opaque() bool }); !ok || !opaque.Opaque() {
+			return false
+		}
+	}
+	return true
+}
+
+// Transform the decoded frames and place the result on screen. Placing again,
+// as toggling with 'f' does, starts over from the decoded frames rather than
+// the previous result, which would get resampled twice.
+func placeImage(imageContext *imgContext, args args, screen_width int, screen_height int) error {
+	if imageContext.unshadowed != nil {
+		// The shadow goes where the image now lands
+		imageContext.background = imageContext.unshadowed
+	}
+	img := imageContext.decoded[0]
+	wImg, err := transformImage(imageContext, img, args, screen_width, screen_height)
+	if err != nil {
+		return fmt.Errorf("%s: %v", imageContext.path, err)
+	}
+	imageContext.frames = nil
+	if len(imageContext.decoded) > 1 {
+		// Frames share the canvas size, hence the same placement
+		imageContext.frames = []image.Image{wImg}
+		frameContext := *imageContext
+		frameArgs := args
+		frameArgs.Verbose = false
+		for _, frame := range imageContext.decoded[1:] {
+			wFrame, err := transformImage(&frameContext, frame, frameArgs, screen_width, screen_height)
+			if err != nil {
+				return fmt.Errorf("%s: %v", imageContext.path, err)
+			}
+			imageContext.frames = append(imageContext.frames, wFrame)
+		}
+	}
+
+	imageContext.image = wImg
+	imageContext.image_width = wImg.Bounds().Max.X
+	if imageContext.image_width > screen_width {
+		imageContext.image_width = screen_width
+	}
+	imageContext.image_height = wImg.Bounds().Max.Y
+	if imageContext.image_height > screen_height {
+		imageContext.image_height = screen_height
+	}
+	if args.Verbose {
+		fmt.Fprintln(os.Stderr, "y from", imageContext.image_yoffset, "to", imageContext.image_yoffset+imageContext.image_height, "x from", imageContext.image_xoffset, "to", imageContext.image_xoffset+imageContext.image_width)
+		fmt.Fprintln(os.Stderr, "screen y from", imageContext.screen_yoffset, "screen x from", imageContext.screen_xoffset)
+	}
+	// The checker pattern, --bgimage and --gradient are shared and do not depend on placement
+	if args.Checkerboard == 0 && args.BgImage.path == "" && args.Gradient == nil {
+		imageContext.background = fillBackground(args.Fill, img, *imageContext, screen_width, screen_height)
+		if imageContext.background != nil && args.ColorMatrix != nil && args.Fill == "blur" {
+			// Blurred from the decoded image, unlike mirrored margins
+			imageContext.background = args.ColorMatrix.apply(imageContext.background)
+		}
+	}
+	// Over a black screen, or behind an image covering it, a shadow would not show
+	if args.Shadow > 0 && imageContext.background != nil && !image.Rect(0, 0, screen_width, screen_height).In(imageContext.screenRect()) {
+		imageContext.unshadowed = imageContext.background
+		imageContext.background = dropShadow(imageContext.background, imageContext.screenRect(), args.Shadow, screen_width, screen_height)
+	}
+	return nil
+}
+
+// Change the transforms of a placed image and place it again from its decoded
+// frames. The image is left as it was if the new transforms fail.
+func (imageContext *imgContext) retransform(transforms []string, args args, screen_width int, screen_height int) error {
+	changed := *imageContext
+	changed.transforms = transforms
+	if err := placeImage(&changed, args, screen_width, screen_height); err != nil {
+		return err
+	}
+	*imageContext = changed
+	return nil
+}
+
+// Apply the transforms to an image, updating its placement, and convert it for rendering.
+func transformImage(imageContext *imgContext, img image.Image, args args, screen_width int, screen_height int) (image.Image, error) {
+	transformStart := time.Now()
+	wImg := img
+	var err error
+	if imageContext.scaleX > 0 && imageContext.scaleY > 0 {
+		wImg, err = resizeImage(wImg,
+			int(math.Round(float64(wImg.Bounds().Dx())*imageContext.scaleX)),
+			int(math.Round(float64(wImg.Bounds().Dy())*imageContext.scaleY)),
+			args)
+		if err != nil {
+			return nil, err
+		}
+		if args.Verbose {
+			fmt.Fprintln(os.Stderr, "Image size at physical scale:", wImg.Bounds())
+		}
+	}
+	for _, transform := range imageContext.transforms {
+		imageContext.image_xoffset, imageContext.image_yoffset, imageContext.screen_xoffset, imageContext.screen_yoffset = 0, 0, 0, 0
+		if transform == "stretch" || transform == "fit" {
+			if args.Verbose {
+				if transform == "fit" {
+					fmt.Fprintln(os.Stderr, "Note: fit stretches the image to the screen, ignoring its aspect ratio; use stretch to say so, or autofit to keep it")
+				}
+				fmt.Fprintln(os.Stderr, "Image size before resizing:", wImg.Bounds())
+			}
+			wImg, err = resizeImage(wImg,
+				resizeTarget(wImg.Bounds().Dx(), screen_width, args.NoUpscale),
+				resizeTarget(wImg.Bounds().Dy(), screen_height, args.NoUpscale),
+				args)
+			if err != nil {
+				return nil, err
+			}
+			if args.Verbose {
+				fmt.Fprintln(os.Stderr, "Image size after resizing:", wImg.Bounds())
+			}
+		} else if transform == "hfit" {
+			if args.Verbose {
+				fmt.Fprintln(os.Stderr, "Image size before horizontal resizing:", wImg.Bounds())
+			}
+			wImg, err = resizeImage(wImg, resizeTarget(wImg.Bounds().Dx(), screen_width, args.NoUpscale), wImg.Bounds().Dy(), args)
+			if err != nil {
+				return nil, err
+			}
+			if args.Verbose {
+				fmt.Fprintln(os.Stderr, "Image size after resizing:", wImg.Bounds())
+			}
+		} else if transform == "vfit" {
+			if args.Verbose {
+				fmt.Fprintln(os.Stderr, "Image size before vertical resizing:", wImg.Bounds())
+			}
+			wImg, err = resizeImage(wImg, wImg.Bounds().Dx(), resizeTarget(wImg.Bounds().Dy(), screen_height, args.NoUpscale), args)
+			if err != nil {
+				return nil, err
+			}
+			if args.Verbose {
+				fmt.Fprintln(os.Stderr, "Image size after resizing:", wImg.Bounds())
+			}
+		} else if transform == "autofit" {
+			if args.Verbose {
+				fmt.Fprintln(os.Stderr, "Image size before proportional resizing:", wImg.Bounds())
+			}
+			width, height := autofitSize(wImg.Bounds().Dx(), wImg.Bounds().Dy(), screen_width, screen_height)
+			wImg, err = resizeImage(wImg,
+				resizeTarget(wImg.Bounds().Dx(), width, args.NoUpscale),
+				resizeTarget(wImg.Bounds().Dy(), height, args.NoUpscale),
+				args)
+			if err != nil {
+				return nil, err
+			}
+			if args.Verbose {
+				fmt.Fprintln(os.Stderr, "Image size after resizing:", wImg.Bounds())
+			}
+		} else if transform == "crop-to-aspect" {
+			// Fitting afterwards fills the screen, as a cover would
+			width, height := cropToAspectSize(wImg.Bounds().Dx(), wImg.Bounds().Dy(), screen_width, screen_height)
+			if width < wImg.Bounds().Dx() || height < wImg.Bounds().Dy() {
+				wImg = imaging.CropCenter(wImg, width, height)
+			}
+			if args.Verbose {
+				fmt.Fprintln(os.Stderr, "Image size after cropping to the screen's aspect ratio:", wImg.Bounds())
+			}
+		} else if transform == "center" {
+			centerImage(imageContext, wImg, screen_width, screen_height, args.Align)
+			if args.Verbose {
+				fmt.Fprintln(os.Stderr, "Image size:", wImg.Bounds())
+			}
+		} else if transform == "rotate90" {
+			wImg = imaging.Rotate270(wImg)
+		} else if transform == "rotate180" {
+			wImg = imaging.Rotate180(wImg)
+		} else if transform == "rotate270" {
+			wImg = imaging.Rotate90(wImg)
+		}
+	}
+
+	if args.Size > 0 {
+		width, height := autofitSize(wImg.Bounds().Dx(), wImg.Bounds().Dy(),
+			int(math.Round(float64(screen_width)*float64(args.Size))), int(math.Round(float64(screen_height)*float64(args.Size))))
+		wImg, err = resizeImage(wImg,
+			resizeTarget(wImg.Bounds().Dx(), width, args.NoUpscale),
+			resizeTarget(wImg.Bounds().Dy(), height, args.NoUpscale),
+			args)
+		if err != nil {
+			return nil, err
+		}
+		if args.Verbose {
+			fmt.Fprintln(os.Stderr, "Image size after fitting", float64(args.Size)*100, "% of the screen:", wImg.Bounds())
+		}
+		centerImage(imageContext, wImg, screen_width, screen_height, args.Align)
+	}
+
+	if args.IntegerScale {
+		factor := screen_width / wImg.Bounds().Dx()
+		if screen_height/wImg.Bounds().Dy() < factor {
+			factor = screen_height / wImg.Bounds().Dy()
+		}
+		if factor > 1 {
+			if err := checkResize(wImg.Bounds().Dx()*factor, wImg.Bounds().Dy()*factor, args); err != nil {
+				return nil, err
+			}
+			wImg = imaging.Resize(wImg, wImg.Bounds().Dx()*factor, wImg.Bounds().Dy()*factor, imaging.NearestNeighbor)
+			if args.Verbose {
+				fmt.Fprintln(os.Stderr, "Image size after scaling by", factor, ":", wImg.Bounds())
+			}
+		}
+		centerImage(imageContext, wImg, screen_width, screen_height, args.Align)
+	}
+
+	if args.Verbose {
+		fmt.Fprintln(os.Stderr, imageContext.path, "transformed in", time.Since(transformStart))
+	}
+
+	conversionStart := time.Now()
+	_, ok := wImg.At(0, 0).(color.NRGBA)
+	if !ok {
+		convertedImg := image.NewNRGBA(image.Rect(0, 0, wImg.Bounds().Dx(), wImg.Bounds().Dy()))
+		draw.Draw(convertedImg, convertedImg.Bounds(), wImg, wImg.Bounds().Min, draw.Src)
+		wImg = convertedImg
+		if args.Verbose {
+			fmt.Fprintln(os.Stderr, imageContext.path, "converted in", time.Since(conversionStart))
+		}
+	}
+	if args.ColorMatrix != nil {
+		wImg = args.ColorMatrix.apply(wImg)
+	}
+
+	return wImg, nil
+}
+
+// Resize with the Lanczos filter or, when shrinking with --supersample, with
+// a bilinear filter to n times the target size then averaging down, which
+// avoids the ringing Lanczos shows on some pictures.
+func resizeImage(img image.Image, width int, height int, args args) (image.Image, error) {
+	if err := checkResize(width, height, args); err != nil {
+		return nil, err
+	}
+	sourceWidth, sourceHeight := img.Bounds().Dx(), img.Bounds().Dy()
+	if args.Supersample > 1 && width <= sourceWidth && height <= sourceHeight && width*height < sourceWidth*sourceHeight {
+		intermediateWidth, intermediateHeight := width*args.Supersample, height*args.Supersample
+		if intermediateWidth > sourceWidth {
+			intermediateWidth = sourceWidth
+		}
+		if intermediateHeight > sourceHeight {
+			intermediateHeight = sourceHeight
+		}
+		intermediate := imaging.Resize(img, intermediateWidth, intermediateHeight, imaging.Linear)
+		return imaging.Resize(intermediate, width, height, imaging.Box), nil
+	}
+	return imaging.Resize(img, width, height, imaging.Lanczos), nil
+}
+
+// Resizing to a huge size, as a tiny --physicaldpi asks for, would take all
+// the memory: with --maxpixels, such resizes are refused.
+func checkResize(width int, height int, args args) error {
+	if args.MaxPixels > 0 && int64(width)*int64(height) > int64(args.MaxPixels) {
+		return fmt.Errorf("resizing to %dx%d exceeds the limit of %d pixels", width, height, args.MaxPixels)
+	}
+	return nil
+}
+
+// File the image is read from, its archive for an archive entry.
+func (imageContext imgContext) filePath() string {
+	if imageContext.archive != "" {
+		return imageContext.archive
+	}
+	return imageContext.path
+}
+
+// Whether the image's file changed since it was decoded. A file that cannot
+// be checked, for instance while being replaced, counts as unchanged.
+func changedOnDisk(imageContext imgContext) bool {
+	if imageContext.image == nil {
+		return false
+	}
+	info, err := os.Stat(imageContext.filePath())
+	if err != nil {
+		return false
+	}
+	return !info.ModTime().Equal(imageContext.modified) || info.Size() != imageContext.size
+}
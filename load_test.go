@@ -0,0 +1,115 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+// A 64x48 image whose every pixel differs, so that any resampling shows.
+func gradientImage() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 4), uint8(y * 5), uint8(x ^ y), 255})
+		}
+	}
+	return img
+}
+
+func TestRetransform(t *testing.T) {
+	decoded := gradientImage()
+	original := image.NewNRGBA(decoded.Bounds())
+	copy(original.Pix, decoded.Pix)
+	args := args{Fill: "none"}
+	place := func(transforms []string) imgContext {
+		imageContext := imgContext{path: "gradient", transforms: transforms, weight: 1, decoded: []image.Image{decoded}}
+		if err := placeImage(&imageContext, args, 32, 24); err != nil {
+			t.Fatal(err)
+		}
+		return imageContext
+	}
+
+	fitted := place([]string{"autofit", "center"})
+	if size := fitted.image.Bounds().Size(); size != image.Pt(32, 24) {
+		t.Fatalf("fitted to %v, want 32x24", size)
+	}
+	actual := fitted
+	if err := actual.retransform([]string{"center"}, args, 32, 24); err != nil {
+		t.Fatal(err)
+	}
+	// From the 32x24 fitted image, actual size would be blurred and smaller
+	if !reflect.DeepEqual(actual.image, place([]string{"center"}).image) || !reflect.DeepEqual(actual.image, original) {
+		t.Errorf("placed at actual size from the fitted image rather than the decoded one")
+	}
+	if actual.image_xoffset != 16 || actual.image_yoffset != 12 {
+		t.Errorf("actual size image shown from %d,%d, want 16,12", actual.image_xoffset, actual.image_yoffset)
+	}
+	refitted := actual
+	if err := refitted.retransform([]string{"autofit", "center"}, args, 32, 24); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(refitted.image, fitted.image) {
+		t.Errorf("fitting again gives another image than fitting at first")
+	}
+	if !reflect.DeepEqual(decoded, original) {
+		t.Errorf("the decoded image changed while transforming it")
+	}
+
+	// Resizing beyond --maxpixels fails, keeping the image as it was
+	limited := args
+	limited.MaxPixels = 100
+	unchanged := actual
+	if err := unchanged.retransform([]string{"autofit", "center"}, limited, 32, 24); err == nil {
+		t.Fatal("resized to 32x24 despite a limit of 100 pixels")
+	}
+	if !reflect.DeepEqual(unchanged, actual) {
+		t.Errorf("a failed change of transforms still changed the image")
+	}
+}
+
+func TestToggleTransforms(t *testing.T) {
+	tests := []struct {
+		transforms []string
+		want       []string
+	}{
+		{[]string{"autofit", "center"}, []string{"center"}},
+		{[]string{"rotate90", "stretch"}, []string{"center"}},
+		{[]string{"center"}, []string{"autofit", "center"}},
+		{nil, []string{"autofit", "center"}},
+	}
+	for _, test := range tests {
+		if got := toggleTransforms(test.transforms); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("toggling %v gives %v, want %v", test.transforms, got, test.want)
+		}
+	}
+}
+
+func TestLoadOnlyKeepsSharedBackground(t *testing.T) {
+	args := args{Fill: "none", Checkerboard: 8}
+	imageContexts := make([]imgContext, 3)
+	shareBackground(imageContexts, args, 32, 24)
+	background := imageContexts[0].background
+	for i := range imageContexts {
+		imageContexts[i].image = gradientImage()
+	}
+	// As left by a shadow, drawn over the shared background
+	imageContexts[2].unshadowed = background
+	imageContexts[2].background = image.NewNRGBA(image.Rect(0, 0, 32, 24))
+
+	if err := loadOnly(imageContexts, []int{0}, args, 32, 24); err != nil {
+		t.Fatal(err)
+	}
+	if imageContexts[0].image == nil {
+		t.Errorf("the wanted image was dropped")
+	}
+	for i, imageContext := range imageContexts[1:] {
+		if imageContext.image != nil {
+			t.Errorf("image %d is still held", i+1)
+		}
+		if imageContext.background != background {
+			t.Errorf("image %d lost the shared background", i+1)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"C"
+	"errors"
 	"fmt"
 	"os"
 )
@@ -9,8 +10,9 @@ import (
 	"image"
 	"image/color"
 	"image/draw"
-	"image/jpeg"
-	"image/png"
+	"math/rand"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -20,7 +22,6 @@ import (
 	"golang.org/x/sys/unix"
 
 	arg "github.com/alexflint/go-arg"
-	"github.com/disintegration/imaging"
 )
 
 type fb_bitfield struct {
@@ -65,21 +66,150 @@ type fb_var_screeninfo struct {
 	reserved     [4]uint32
 }
 
+type fb_fix_screeninfo struct {
+	id           [16]byte
+	smem_start   uintptr
+	smem_len     uint32
+	fbtype       uint32
+	type_aux     uint32
+	visual       uint32
+	xpanstep     uint16
+	ypanstep     uint16
+	ywrapstep    uint16
+	line_length  uint32
+	mmio_start   uintptr
+	mmio_len     uint32
+	accel        uint32
+	capabilities uint16
+	reserved     [2]uint16
+}
+
 const FBIOGET_FSCREENINFO = 0x4602
 const FBIOGET_VSCREENINFO = 0x4600
+const FBIOPUT_VSCREENINFO = 0x4601
+
+// _IOW('F', 0x20, __u32)
+const FBIO_WAITFORVSYNC = 0x40044620
+
+// Values of fb_var_screeninfo.activate. Drivers only apply a put request
+// right away when asked to, and FB_ACTIVATE_FORCE makes them apply it even
+// when they believe the mode is unchanged.
+const FB_ACTIVATE_NOW = 0
+const FB_ACTIVATE_FORCE = 128
+
+var screenRotations = map[int]uint32{
+	90:  1, // FB_ROTATE_CW
+	180: 2, // FB_ROTATE_UD
+	270: 3, // FB_ROTATE_CCW
+}
 
 type args struct {
-	ImgPath    []string `arg:"positional,required"`
-	DevicePath string   `default:"/dev/fb0"`
-	Transform  []string `arg:"separate" help:"can be invoked multiple times\n                         accepted: fit hfit vfit center"`
-	DontClear  bool     `help:"do not clear screen before rendering image"`
-	NoCursor   bool     `help:"hide console cursor"`
-	Redraw     int      `help:"keep re-rendering image every n seconds, hiding console output"`
-	Verbose    bool
+	ImgPath      []string  `arg:"positional"`
+	Playlist     string    `help:"file listing images, one per line: path [seconds] [transforms...]"`
+	Sequence     *sequence `help:"play numbered images as the frames of an animation at --fps (25 by default), given as template:first-last, e.g. frame_%04d.png:1-120"`
+	WaitForFb    int       `help:"keep trying to open the device for up to n seconds, for instance during boot"`
+	DevicePath   string    `help:"framebuffer device [default: /dev/fb0, or /dev/dri/card0 with --backend drm]"`
+	Backend      string    `default:"fbdev" help:"how to reach the screen: fbdev, or drm for kernels without framebuffer devices"`
+	Fb           *int      `help:"framebuffer device by number, as in --fb 1 for /dev/fb1"`
+	Transform    []string  `arg:"separate" help:"can be invoked multiple times\n                         accepted: stretch hfit vfit autofit crop-to-aspect center rotate90 rotate180 rotate270 (clockwise)\n                         fit is an alias of stretch, ignoring the aspect ratio"`
+	Transforms   string    `help:"comma-separated transforms added after those given with --transform, e.g. fit,center"`
+	OnExit       string    `default:"leave" help:"screen content on exit: leave, clear or restore what was there before"`
+	Compose      bool      `help:"draw images over their background on a screen-sized canvas, then convert it all at once"`
+	DontClear    bool      `help:"do not clear screen before rendering image, only the area of the previous one"`
+	ClearOnce    bool      `help:"clear the whole screen before the first image only, then as with --dontclear"`
+	Fill         string    `default:"none" help:"margins around letterboxed images: none, blur or mirror the image"`
+	Checkerboard int       `help:"show a gray checker pattern of n-pixel squares behind images, revealing transparency"`
+	Gradient     *gradient `help:"shade the screen behind images from one color to another, rrggbb:rrggbb from top to bottom, or left to right ending with :h"`
+	BgImage      backdrop  `help:"draw this image behind every image, cropped to fill the screen, showing through their transparent parts"`
+	NoCursor     bool      `help:"hide console cursor"`
+	ParkCursor   bool      `help:"move the console cursor to the bottom-right corner, for consoles ignoring --nocursor"`
+	Redraw       interval  `help:"keep re-rendering image at this interval, hiding console output: seconds or a duration such as 500ms"`
+	IfChanged    bool      `help:"with --redraw, read images again only once their file changed, and otherwise leave the screen alone"`
+	LoopCount    int       `help:"move on from animated images once played n times, instead of after --redraw"`
+	LoopMax      interval  `help:"longest time animated images play with --loopcount, in seconds or as a duration (0: no limit)"`
+	StartIndex   int       `help:"begin the slideshow with the nth image, counting from 1 as --showindex does"`
+	Timeout      interval  `help:"exit after this time, restoring the cursor and console as Esc does, e.g. 10s for a splash screen"`
+	Repeat       int       `help:"for burn-in tests, cycle through the images n times per second, within --fps, then report the frame rate achieved"`
+	Duration     interval  `help:"how long --repeat runs, in seconds or as a duration (0: until Esc)"`
+	FadeIn       interval  `help:"fade the first image in from black over this time, in seconds or as a duration such as 1s; Esc skips to the end"`
+	Manual       bool      `help:"stay on each image until Space or the right arrow is pressed, ignoring --redraw"`
+	RepeatLast   bool      `help:"stay on the last image instead of looping back to the first"`
+	Shuffle      bool      `help:"show images in random order, favouring those with a weight as in sunset.jpg#3"`
+	RotateScreen int       `help:"rotate the screen using the framebuffer driver: 90 180 270"`
+	AutoOrient   bool      `help:"turn JPEG photos upright according to their EXIF orientation, before any transform"`
+	NoProfile    bool      `help:"show PNG and JPEG images as is, without converting their embedded color profile or gamma to sRGB"`
+	PhysicalDPI  float64   `help:"show images at their physical size, given their resolution in dots per inch, using the screen size reported by the driver"`
+	Montage      *grid     `help:"show images side by side in a grid of CxR cells, e.g. 2x2, a screenful per slide"`
+	Size         percent   `help:"fit images within this share of the screen, keeping their aspect ratio, then center them, e.g. 80%"`
+	IntegerScale bool      `help:"enlarge small images by a whole factor, keeping pixels crisp, then center them"`
+	Border       *border   `help:"draw a frame around images, given as width:rrggbb, e.g. 8:ffffff"`
+	Shadow       int       `help:"cast a soft shadow of n pixels below and right of images, over their background"`
+	Watermark    watermark `help:"blend a logo in a corner of every image, given as path:corner:opacity, e.g. logo.png:bottom-right:0.5"`
+	Align        alignment `help:"anchor used by center: top bottom left right, or combined as in bottom-left"`
+	Supersample  int       `help:"shrink images by resizing them to n times the target size, then averaging, which rings less than the default filter"`
+	NoUpscale    bool      `help:"fit transforms only shrink images larger than the screen"`
+	MaxPixels    int       `help:"refuse to decode images larger than this many pixels, or to resize them any larger (0: no limit)"`
+	Preload      bool      `help:"decode every image before showing the first one [default]"`
+	Lazy         bool      `help:"decode each image just before it is shown, keeping only the current and next ones in memory"`
+	ShowIndex    bool      `help:"display slideshow position in a corner, toggle with '#'"`
+	ShowInfo     bool      `help:"display the image's path, format and size as decoded and as transformed in a corner, toggle with 'i'"`
+	Clock        bool      `help:"display the time in a corner, updated every second"`
+	Fps          int       `help:"show at most n animation frames per second, sparing slow CPUs (0: no limit)"`
+	TimeFormat   string    `default:"15:04:05" help:"Go time layout used by --clock"`
+	PlayLog      string    `help:"append a JSON line to this file for each image shown: time, path and duration"`
+	ListModes    bool      `help:"print the modes the screen supports, as listed by the kernel, and exit"`
+	Screenshot   string    `help:"save the current screen content to a PNG file ('-' for stdout) and exit"`
+	RenderTo     string    `help:"draw images to a PNG file ('-' for stdout) instead of the framebuffer, on a --geometry sized screen"`
+	DryRun       bool      `help:"decode and transform the images, reporting errors and placements, without using the framebuffer"`
+	Bench        int       `arg:"-"` // runs of the bench subcommand
+	Fallback     string    `help:"when the screen cannot be opened, show images in the terminal instead: sixel"`
+	TestPattern  bool      `help:"draw color bars, gradients, a grid and corner markers to check colors and geometry, then exit"`
+	Fifo         string    `help:"named pipe, created if missing, where each line written is an image shown in place of the current one"`
+	MinInterval  interval  `help:"show images from --fifo at most this often, skipping to the latest one: seconds or a duration such as 500ms"`
+	PollInterval interval  `default:"100ms" help:"how often keys and console switches are checked between redraws: lower answers faster, higher wakes the CPU less"`
+	NoKeyboard   bool      `help:"do not read keys, for headless use where there is no terminal"`
+	DeleteKey    string    `default:"d" help:"key moving the current image to the trash directory"`
+	SnapshotDir  string    `default:"." help:"where 's' saves what the screen shows as a timestamped PNG"`
+	TrashDir     string    `help:"where deleted images are moved [default: ~/.local/share/Trash/files]"`
+	FlipOutput   string    `help:"mirror what is written to the screen, for panels wired upside down: v, h or both"`
+	DiffRender   bool      `help:"only write pixels that differ from what the framebuffer shows, for slow displays"`
+	VerifyWrite  bool      `help:"read the framebuffer back after each write and report bytes that differ, to diagnose drivers"`
+	Sync         bool      `help:"ask the driver to refresh the screen after each write, for displays showing stale images"`
+	ColorMatrix  *matrix   `help:"correct the colors of images with a matrix: 9 factors row by row, or 12 with an offset ending each row, e.g. 0,0,1,0,1,0,1,0,0 swaps red and blue"`
+	LinearBlend  bool      `help:"blend translucent pixels in linear light, slower but truer to antialiased edges"`
+	NoAlpha      bool      `help:"write pixels as fully opaque, ignoring the image's alpha channel"`
+	PixelFormat  string    `arg:"env:FBV_PIXELFORMAT" help:"override the pixel layout reported by the driver: bgra rgba argb bgr24 rgb24 rgb565 rgb555 rgb666 rgb30 indexed"`
+	Geometry     *geometry `arg:"env:FBV_GEOMETRY" help:"use this WxHxBPP screen instead of asking the driver, e.g. 1920x1080x32"`
+	FbOffset     int       `help:"bytes reserved by the device at the start of the framebuffer memory, where pixels start"`
+	MirrorTo     string    `help:"also show the screen content, scaled, on this second framebuffer device, given as a path or a number"`
+	Viewport     *viewport `help:"only draw within this x,y,w,h part of the screen, which transforms fit images into"`
+	Verbose      bool
+	Quiet        bool `help:"only report errors, overrides --verbose"`
 }
 
 type imgContext struct {
+	path           string
+	transforms     []string
+	redraw         time.Duration
+	scaleX         float64 // resizing applied before transforms, 0 for none
+	scaleY         float64
+	weight         int
 	image          image.Image
+	decoded        []image.Image // frames as decoded, kept for transforming again from the original
+	format         string        // as detected when decoding
+	archive        string        // archive the image is read from, see archive.go
+	entry          string        // name of the image within the archive
+	section        tarSection    // where the image lies within an uncompressed tar
+	data           []byte        // content of an image given as a data URI, see datauri.go, or read from a compressed tar
+	sequence       []string      // paths of the frames, see --sequence
+	toggled        []string      // transforms 'f' switches to, swapped with the shown ones each time
+	opaque         bool          // no alpha in any frame, drawn without blending
+	modified       time.Time     // file's modification time and size when decoded, see --ifchanged
+	size           int64
+	background     image.Image
+	unshadowed     image.Image // background before --shadow was cast on it
+	frames         []image.Image
+	delays         []time.Duration
 	image_width    int
 	image_height   int
 	image_xoffset  int
@@ -89,215 +219,1395 @@ type imgContext struct {
 }
 
 func (args) Description() string {
-	return "Display an image in your graphical console using the frame buffer.\nYou may apply multiple transformations.\n"
+	return "Display an image in your graphical console using the frame buffer.\nYou may apply multiple transformations.\n" +
+		"Press Esc to quit, f to switch between fitted and actual size, i to show image information.\n" +
+		"With --manual, press Space or the right arrow for the next image.\n" +
+		"Run modernfbv bench with the same options to time decoding, transforms and drawing in memory.\n"
+}
+
+// The bench subcommand takes the options of showing images. As go-arg does
+// not allow subcommands next to the image paths, it is parsed apart.
+type benchCommand struct {
+	args
+	Runs int `default:"10" help:"how many times each phase runs"`
+}
+
+type commandLine struct {
+	Bench *benchCommand `arg:"subcommand:bench" help:"decode, transform and draw images in memory, without using the framebuffer, and report how long each phase takes"`
 }
 
 func main() {
 	var args args
-	arg.MustParse(&args)
+	var p *arg.Parser
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		var command commandLine
+		p = arg.MustParse(&command)
+		args = command.Bench.args
+		args.Bench = command.Bench.Runs
+		if args.Bench <= 0 {
+			p.FailSubcommand("--runs must be positive", "bench")
+		}
+	} else {
+		p = arg.MustParse(&args)
+	}
+	if len([]rune(args.DeleteKey)) != 1 {
+		p.Fail("--deletekey must be a single character")
+	}
+	if strings.Contains("f#is", args.DeleteKey) {
+		p.Fail("--deletekey cannot be f, #, i or s, which are bound already")
+	}
+	if !fillModes[args.Fill] {
+		p.Fail("--fill must be none, blur or mirror")
+	}
+	if args.Checkerboard < 0 || (args.Checkerboard > 0 && args.Fill != "none") {
+		p.Fail("--checkerboard takes a positive square size and cannot be combined with --fill")
+	}
+	if args.StartIndex < 0 {
+		p.Fail("--startindex counts from 1")
+	}
+	if args.LoopCount < 0 {
+		p.Fail("--loopcount cannot be negative")
+	}
+	if args.Repeat < 0 {
+		p.Fail("--repeat cannot be negative")
+	}
+	if args.Repeat > 0 && args.Lazy {
+		p.Fail("--repeat renders every image in advance and cannot be combined with --lazy")
+	}
+	if args.Duration > 0 && args.Repeat == 0 {
+		p.Fail("--duration only applies to --repeat")
+	}
+	if args.PollInterval <= 0 {
+		p.Fail("--pollinterval must be positive")
+	}
+	if args.Shadow < 0 {
+		p.Fail("--shadow cannot be negative")
+	}
+	if args.Fps < 0 {
+		p.Fail("--fps cannot be negative")
+	}
+	if args.BgImage.path != "" && (args.Checkerboard > 0 || args.Fill != "none") {
+		p.Fail("--bgimage cannot be combined with --fill or --checkerboard")
+	}
+	if args.Gradient != nil && (args.BgImage.path != "" || args.Checkerboard > 0 || args.Fill != "none") {
+		p.Fail("--gradient cannot be combined with --bgimage, --fill or --checkerboard")
+	}
+	if args.Compose && (args.DontClear || args.ClearOnce) {
+		p.Fail("--compose draws the whole screen and cannot be combined with --dontclear or --clearonce")
+	}
+	if args.DontClear && args.ClearOnce {
+		p.Fail("--dontclear and --clearonce cannot be combined")
+	}
+	if args.FlipOutput != "" && args.FlipOutput != "v" && args.FlipOutput != "h" && args.FlipOutput != "both" {
+		p.Fail("--flipoutput must be v, h or both")
+	}
+	if !fallbacks[args.Fallback] {
+		p.Fail("--fallback must be sixel")
+	}
+	if !displayBackends[args.Backend] {
+		p.Fail("--backend must be fbdev or drm")
+	}
+	if args.OnExit != "leave" && args.OnExit != "clear" && args.OnExit != "restore" {
+		p.Fail("--onexit must be leave, clear or restore")
+	}
+	if args.Backend == "drm" && (args.Fb != nil || args.Geometry != nil || args.RotateScreen != 0 || args.FbOffset != 0) {
+		p.Fail("--fb, --geometry, --rotatescreen and --fboffset only apply to framebuffer devices")
+	}
+	if args.FbOffset < 0 {
+		p.Fail("--fboffset cannot be negative")
+	}
+	if args.Fb != nil {
+		if args.DevicePath != "" {
+			p.Fail("--fb and --devicepath cannot be combined")
+		}
+		if *args.Fb < 0 {
+			p.Fail("--fb cannot be negative")
+		}
+		args.DevicePath = fbDevicePath(strconv.Itoa(*args.Fb))
+	}
+	if args.DevicePath == "" && args.Backend == "drm" {
+		args.DevicePath = "/dev/dri/card0"
+	}
+	if args.DevicePath == "" {
+		args.DevicePath = "/dev/fb0"
+	}
+	if args.MirrorTo != "" {
+		args.MirrorTo = fbDevicePath(args.MirrorTo)
+	}
+	if args.Manual && args.NoKeyboard {
+		p.Fail("--manual needs the keyboard")
+	}
+	if args.Size > 0 && args.IntegerScale {
+		p.Fail("--size and --integerscale cannot be combined")
+	}
+	if args.Montage != nil && args.Lazy {
+		p.Fail("--montage lays images out in advance and cannot be combined with --lazy")
+	}
+	if args.Preload && args.Lazy {
+		p.Fail("--preload and --lazy cannot be combined")
+	}
+	if args.Geometry != nil && args.RotateScreen != 0 {
+		p.Fail("--geometry cannot be combined with --rotatescreen")
+	}
+	for _, transform := range strings.Split(args.Transforms, ",") {
+		if transform != "" {
+			args.Transform = append(args.Transform, transform)
+		}
+	}
+	if args.TrashDir == "" {
+		args.TrashDir = defaultTrashDir()
+	}
+	if args.Quiet {
+		args.Verbose = false
+	}
+	// Preloading is what happens unless --lazy turns it off
+	args.Preload = !args.Lazy
+	if args.Shuffle {
+		rand.Seed(time.Now().UnixNano())
+	}
 
-	fbF, err := os.OpenFile(args.DevicePath, os.O_RDWR, os.ModeDevice)
+	err := run(args)
 	if err != nil {
-		fmt.Println(err)
-		return
+		fmt.Fprintln(os.Stderr, err)
+	}
+	os.Exit(exitCode(err))
+}
+
+// Framebuffer devices may be given by number, as in 1 for /dev/fb1.
+func fbDevicePath(device string) string {
+	if index, err := strconv.Atoi(device); err == nil && index >= 0 {
+		return fmt.Sprintf("/dev/fb%d", index)
+	}
+	return device
+}
+
+// Everything after parsing the flags, returning so that deferred cleanups
+// run before the process exits.
+func run(args args) error {
+	if args.ListModes {
+		return listModes(args)
+	}
+	sources := []imgContext{}
+	for _, imgPath := range args.ImgPath {
+		if isDataURI(imgPath) {
+			entry, err := readDataURI(imgPath, args.Transform)
+			if err != nil {
+				return fmt.Errorf("%w: %v", errInput, err)
+			}
+			sources = append(sources, entry)
+			continue
+		}
+		if isArchive(imgPath) {
+			entries, err := readArchive(imgPath, args.Transform)
+			if err != nil {
+				return fmt.Errorf("%w: %v", errInput, err)
+			}
+			sources = append(sources, entries...)
+			continue
+		}
+		sources = append(sources, newImgContext(imgPath, args.Transform))
+	}
+	if args.Playlist != "" {
+		entries, err := readPlaylist(args.Playlist, args.Transform)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInput, err)
+		}
+		sources = append(sources, entries...)
+	}
+	if args.Sequence != nil {
+		sources = append(sources, args.Sequence.context(args.Transform))
+	}
+	if args.DryRun {
+		return dryRun(sources, args)
+	}
+	if args.RenderTo != "" {
+		return renderToFile(sources, args)
+	}
+	if args.Bench > 0 {
+		return bench(sources, args)
+	}
+
+	screeninfo := fb_var_screeninfo{}
+	screenDevice, err := openDisplay(args, &screeninfo)
+	if err != nil {
+		if args.Fallback == "sixel" && errors.Is(err, errDevice) {
+			if args.Verbose {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			return showSixel(sources, args)
+		}
+		return err
 	}
-	defer fbF.Close()
+	// The device may get opened again, see watchdog.go
+	defer func() {
+		screenDevice.close()
+	}()
 
-	if args.NoCursor {
+	if args.NoCursor || args.ParkCursor {
 		fbT, err := os.OpenFile("/dev/console", unix.O_WRONLY, 0)
 		if err != nil {
-			fmt.Println(err)
-			return
+			return err
 		}
 		defer func() {
-			fbT.WriteString("\033[?25h")
+			if args.NoCursor {
+				fbT.WriteString("\033[?25h")
+			}
+			if args.ParkCursor {
+				fbT.WriteString("\0338")
+			}
 			time.Sleep(1 * time.Second)
 			fbT.Close()
 		}()
-		fbT.WriteString("\033[?25l")
+		if args.NoCursor {
+			fbT.WriteString("\033[?25l")
+		}
+		if args.ParkCursor {
+			// Save the position, then go as far down and right as the console allows
+			fbT.WriteString("\0337\033[999;999H")
+		}
 	}
 
-	screeninfo := fb_var_screeninfo{}
-	uscreeninfo := unsafe.Pointer(&screeninfo)
-	_, _, err = syscall.Syscall(syscall.SYS_IOCTL, fbF.Fd(), FBIOGET_VSCREENINFO, uintptr(uscreeninfo))
-	if int(err.(syscall.Errno)) != 0 {
-		fmt.Println(err)
-		return
+	if screeninfo.xres == 0 || screeninfo.yres == 0 || screeninfo.bits_per_pixel == 0 {
+		return fmt.Errorf("%w: %s reports a %dx%d screen at %d bits per pixel, it does not appear to be active",
+			errDevice, args.DevicePath, screeninfo.xres, screeninfo.yres, screeninfo.bits_per_pixel)
+	}
+	var format pixelFormat
+	if args.PixelFormat != "" {
+		var ok bool
+		format, ok = pixelFormats[args.PixelFormat]
+		if !ok {
+			return fmt.Errorf("%w: unknown pixel format: %s", errUsage, args.PixelFormat)
+		}
+		// Otherwise every line would be written past its end, and the last ones past the memory
+		if format.bytes != depthBytes(screeninfo.bits_per_pixel) {
+			return fmt.Errorf("%w: %s takes %d bytes per pixel, the screen has %d bits per pixel",
+				errPixelFormat, args.PixelFormat, format.bytes, screeninfo.bits_per_pixel)
+		}
+	} else {
+		if _, ok := depthFormats[screeninfo.bits_per_pixel]; !ok {
+			return fmt.Errorf("%w: %d bits per pixel", errPixelFormat, screeninfo.bits_per_pixel)
+		}
+		format = detectPixelFormat(screeninfo)
+	}
+	format.opaque = args.NoAlpha
+	if format.bytes == 1 {
+		format.palette = newPalette()
 	}
+	// Images are sized for the visible screen: some drivers report huge
+	// virtual resolutions, only used for the layout in memory
 	screen_width := int(screeninfo.xres)
 	screen_height := int(screeninfo.yres)
-	bpp := int(screeninfo.bits_per_pixel / 8)
+	screen, mappedPixels, err := screenDevice.mapScreen(screeninfo, format)
+	if err != nil {
+		if errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EPERM) {
+			return fmt.Errorf("%w: %s cannot be mapped for writing: %v", errDevice, args.DevicePath, err)
+		}
+		return fmt.Errorf("%w: %v", errDevice, err)
+	}
+	screen.linear = args.LinearBlend
+	defer func() {
+		syscall.Munmap(mappedPixels)
+	}()
 	if args.Verbose {
-		fmt.Println("Screen information:", screen_width, screen_height, bpp)
+		fmt.Fprintln(os.Stderr, "Screen information:", screen_width, screen_height, format.bytes)
+		if format.palette != nil {
+			fmt.Fprintln(os.Stderr, "Pixel format: 256 colors palette")
+		} else {
+			fmt.Fprintln(os.Stderr, "Pixel format: red", format.red, "green", format.green, "blue", format.blue, "transparency", format.transp)
+		}
+		if screeninfo.xoffset != 0 || screeninfo.yoffset != 0 {
+			fmt.Fprintln(os.Stderr, "Visible region panned to", screeninfo.xoffset, screeninfo.yoffset, "line width:", screen.stride)
+		}
+	}
+	if args.Viewport != nil {
+		rect := image.Rectangle(*args.Viewport)
+		if !rect.In(image.Rect(0, 0, screen_width, screen_height)) {
+			return fmt.Errorf("%w: viewport %v exceeds the %dx%d screen", errUsage, rect, screen_width, screen_height)
+		}
+		screen = screen.sub(rect)
+		screen_width = rect.Dx()
+		screen_height = rect.Dy()
 	}
 
-	imageContexts := []imgContext{}
+	if args.Screenshot != "" {
+		return writePNG(args.Screenshot, captureScreen(screen))
+	}
 
-	for _, imgPath := range args.ImgPath {
-		imageContext := imgContext{}
+	// Only now, as a screenshot needs nothing but reading
+	err = probeWrite(screen.pixels)
+	if err != nil {
+		return fmt.Errorf("%w: %s is read-only: %v", errDevice, args.DevicePath, err)
+	}
+
+	if args.TestPattern {
+		drawImage(screen, imgContext{
+			image:        testPattern(screen_width, screen_height),
+			image_width:  screen_width,
+			image_height: screen_height,
+		})
+		return nil
+	}
+
+	switch args.OnExit {
+	case "leave":
+	case "clear":
+		defer func() {
+			if mappedPixels != nil {
+				clearRect(screen, image.Rect(0, 0, screen_width, screen_height))
+			}
+		}()
+	case "restore":
+		// Only what we may draw over, leaving the rest of the screen alone
+		saved := newBackBuffer(screen)
+		saved.markDirty(image.Rect(0, 0, screen_width, screen_height))
+		defer func() {
+			if mappedPixels != nil {
+				saved.front = screen
+				saved.flush()
+			}
+		}()
+	}
+
+	if len(sources) == 0 {
+		return fmt.Errorf("%w: no image to display", errUsage)
+	}
+	if args.StartIndex > len(sources) {
+		return fmt.Errorf("%w: cannot start with image %d of %d", errUsage, args.StartIndex, len(sources))
+	}
+
+	if args.PhysicalDPI > 0 {
+		if screeninfo.width == 0 || screeninfo.height == 0 {
+			return fmt.Errorf("%w: %s does not report its physical size", errDevice, args.DevicePath)
+		}
+		// Screen pixels per image pixel, from the screen's dots per inch
+		scaleX := float64(screeninfo.xres) * 25.4 / float64(screeninfo.width) / args.PhysicalDPI
+		scaleY := float64(screeninfo.yres) * 25.4 / float64(screeninfo.height) / args.PhysicalDPI
+		if args.Verbose {
+			fmt.Fprintln(os.Stderr, "Physical size scaling:", scaleX, scaleY)
+		}
+		for i := range sources {
+			sources[i].scaleX, sources[i].scaleY = scaleX, scaleY
+		}
+	}
+
+	slideshow := args.Manual || args.Timeout > 0
+	exitAt := time.Now().Add(time.Duration(args.Timeout))
+	for i := range sources {
+		if sources[i].redraw == 0 {
+			sources[i].redraw = time.Duration(args.Redraw)
+		}
+		if sources[i].redraw > 0 {
+			slideshow = true
+		}
+	}
 
-		imgF, err := os.Open(imgPath)
+	if args.BgImage.path != "" {
+		if err := args.BgImage.load(args, screen_width, screen_height); err != nil {
+			return fmt.Errorf("%w: background %v", errInput, err)
+		}
+	}
+	var progress func(loaded int, total int)
+	if len(sources) > 1 && !args.DontClear && format.palette == nil {
+		// Not on 8-bit screens, whose palette is only set with the first image
+		loadStart := time.Now()
+		progress = func(loaded int, total int) {
+			if time.Since(loadStart) >= progressDelay {
+				drawProgress(screen, loaded, total)
+			}
+		}
+	}
+	var imageContexts []imgContext
+	if !args.Preload {
+		// Images are loaded when their turn comes, over a background made once
+		shareBackground(sources, args, screen_width, screen_height)
+		imageContexts = sources
+	} else if args.Montage != nil {
+		imageContexts, err = loadMontage(sources, args, screen_width, screen_height, progress)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInput, err)
+		}
+	} else {
+		imageContexts, err = loadImages(sources, args, screen_width, screen_height, progress)
 		if err != nil {
-			fmt.Println(err)
-			return
+			return fmt.Errorf("%w: %v", errInput, err)
 		}
-		defer imgF.Close()
+	}
+	for _, imageContext := range imageContexts {
+		if len(imageContext.frames) > 1 {
+			slideshow = true
+		}
+	}
+	if args.Watermark.path != "" {
+		if err := args.Watermark.load(args, screen_width, screen_height); err != nil {
+			return fmt.Errorf("%w: watermark %v", errInput, err)
+		}
+	}
 
-		var img image.Image
-		if strings.HasSuffix(imgPath, ".png") {
-			img, err = png.Decode(imgF)
-		} else if strings.HasSuffix(imgPath, ".jpg") || strings.HasSuffix(imgPath, ".jpeg") {
-			img, err = jpeg.Decode(imgF)
+	// Without a keyboard, the events channel stays nil and never delivers
+	var keysEvents <-chan keyboard.KeyEvent
+	if !args.NoKeyboard {
+		keysEvents, err = keyboard.GetKeys(1)
+		if err != nil && args.Manual {
+			return err
+		}
+		if err != nil {
+			// Typically no controlling terminal, as under a service manager
+			if !args.Quiet {
+				fmt.Fprintln(os.Stderr, "Keyboard unavailable, Esc and other keys are ignored:", err)
+			}
+			keysEvents = nil
+		} else {
+			defer func() {
+				_ = keyboard.Close()
+			}()
 		}
+	}
+
+	var pushes <-chan string
+	if args.Fifo != "" {
+		pushes, err = watchFifo(args.Fifo, time.Duration(args.MinInterval), args.Verbose)
 		if err != nil {
-			fmt.Println(err)
-			return
+			return err
 		}
+		slideshow = true
+	}
 
-		var wImg image.Image
-		wImg = img
-		for _, transform := range args.Transform {
-			imageContext.image_xoffset, imageContext.image_yoffset, imageContext.screen_xoffset, imageContext.screen_yoffset = 0, 0, 0, 0
-			if transform == "fit" {
-				if args.Verbose {
-					fmt.Println("Image size before resizing:", wImg.Bounds())
+	var switcher *vtSwitcher
+	var vtSignals chan os.Signal
+	if slideshow || args.Clock {
+		switcher, err = watchVTSwitch()
+		if err != nil {
+			if args.Verbose {
+				fmt.Fprintln(os.Stderr, "Not watching for console switches:", err)
+			}
+		} else {
+			defer switcher.close()
+			vtSignals = switcher.signals
+			defer func() {
+				// Do not leave a pending switch hanging on exit
+				select {
+				case sig := <-vtSignals:
+					switcher.acknowledge(sig)
+				default:
 				}
-				wImg = imaging.Resize(wImg, screen_width, screen_height, imaging.Lanczos)
-				if args.Verbose {
-					fmt.Println("Image size after resizing:", wImg.Bounds())
+			}()
+		}
+	}
+
+	curImageContextIdx := 0
+	if args.StartIndex > 0 {
+		// Images that failed to load are not counted
+		curImageContextIdx = args.StartIndex - 1
+		if curImageContextIdx >= len(imageContexts) {
+			curImageContextIdx = len(imageContexts) - 1
+		}
+	} else if args.Shuffle {
+		curImageContextIdx = pickWeighted(imageContexts, -1)
+	}
+	foreground := true
+	lastClock := ""
+	lastDrawn := image.Rectangle{}
+	// Index of the image held by the back buffer, -1 to force rendering again
+	renderedIdx := -1
+	// Whether --clearonce has cleared the screen already
+	screenCleared := false
+	fading := args.FadeIn > 0
+	back := newBackBuffer(screen)
+	back.diff = args.DiffRender
+	back.verify = args.VerifyWrite
+	back.flipX = args.FlipOutput == "h" || args.FlipOutput == "both"
+	back.flipY = args.FlipOutput == "v" || args.FlipOutput == "both"
+	var mirror *mirrorScreen
+	if args.MirrorTo != "" {
+		mirror, err = openMirror(args.MirrorTo, args.NoAlpha)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errDevice, err)
+		}
+		defer mirror.close()
+	}
+	reopen := func() error {
+		if args.Verbose {
+			fmt.Fprintln(os.Stderr, "Framebuffer lost, opening it again")
+		}
+		syscall.Munmap(mappedPixels)
+		mappedPixels = nil
+		screenDevice.close()
+		previous, previousDevice := screeninfo, screenDevice
+		screenDevice, err = openDisplay(args, &screeninfo)
+		if err != nil {
+			return err
+		}
+		// Restore on exit what the screen was before the run, not before this reopen
+		if fb, ok := screenDevice.(*fbDisplay); ok {
+			if previousFb, ok := previousDevice.(*fbDisplay); ok && previousFb.rotated {
+				fb.rotated, fb.original = true, previousFb.original
+			}
+		}
+		if screeninfo.xres != previous.xres || screeninfo.yres != previous.yres || screeninfo.bits_per_pixel != previous.bits_per_pixel {
+			return fmt.Errorf("%w: %s came back with a different screen", errDevice, args.DevicePath)
+		}
+		screen, mappedPixels, err = screenDevice.mapScreen(screeninfo, format)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errDevice, err)
+		}
+		if args.Viewport != nil {
+			screen = screen.sub(image.Rectangle(*args.Viewport))
+		}
+		back.front = screen
+		back.markDirty(image.Rect(0, 0, screen_width, screen_height))
+		if format.palette != nil {
+			format.palette.pending = true
+		}
+		return nil
+	}
+	lastCheck := time.Now()
+	var plays *playLog
+	if args.PlayLog != "" {
+		plays, err = openPlayLog(args.PlayLog)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := plays.close(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}()
+	}
+	flush := func() error {
+		if time.Since(lastCheck) >= watchdogInterval {
+			lastCheck = time.Now()
+			if !screenDevice.valid() {
+				if err := reopen(); err != nil {
+					return err
 				}
-			} else if transform == "hfit" {
+			}
+		}
+		if format.palette != nil && format.palette.pending {
+			if err := screenDevice.loadPalette(format.palette.colors[:]); err != nil {
+				return fmt.Errorf("%w: cannot set the palette: %v", errDevice, err)
+			}
+			format.palette.pending = false
+		}
+		changed := len(back.dirty) > 0
+		if writeGuarded(back.flush) != nil {
+			if err := reopen(); err != nil {
+				return err
+			}
+			if err := writeGuarded(back.flush); err != nil {
+				return fmt.Errorf("%w: %v", errDevice, err)
+			}
+		}
+		if args.Sync && changed {
+			if err := screenDevice.sync(mappedPixels); err != nil && args.Verbose {
+				fmt.Fprintln(os.Stderr, "Cannot sync the screen:", err)
+			}
+		}
+		if back.mismatched > 0 {
+			fmt.Fprintf(os.Stderr, "Framebuffer write check: %d bytes read back differ from what was written, within %v\n", back.mismatched, back.mismatchArea)
+			back.mismatched, back.mismatchArea = 0, image.Rectangle{}
+		} else if args.VerifyWrite && args.Verbose && changed {
+			fmt.Fprintln(os.Stderr, "Framebuffer write check: read back as written")
+		}
+		if mirror != nil && changed {
+			mirror.update(back.screenBuffer)
+		}
+		return nil
+	}
+	showIndex := func() {
+		back.markDirty(drawOverlay(back.screenBuffer,
+			renderText(fmt.Sprintf("%d / %d", curImageContextIdx+1, len(imageContexts))), overlayBottomRight))
+	}
+	showInfo := func() {
+		imageContext := imageContexts[curImageContextIdx]
+		decoded := imageContext.decoded[0].Bounds()
+		details := fmt.Sprintf(": %s %dx%d, transformed to %dx%d", imageContext.format,
+			decoded.Dx(), decoded.Dy(), imageContext.image.Bounds().Dx(), imageContext.image.Bounds().Dy())
+		info := renderText(imageContext.path + details)
+		if info.Bounds().Dx()+2*overlayMargin > screen_width {
+			// Overlays not fitting on screen are left out
+			info = renderText(filepath.Base(imageContext.path) + details)
+		}
+		back.markDirty(drawOverlay(back.screenBuffer, info, overlayBottomLeft))
+	}
+	if args.Repeat > 0 {
+		return repeatImages(back, imageContexts, args, flush, keysEvents)
+	}
+	for {
+		for !args.Preload && imageContexts[curImageContextIdx].image == nil {
+			err = loadOnly(imageContexts, []int{curImageContextIdx}, args, screen_width, screen_height)
+			if err == nil {
+				break
+			}
+			if len(imageContexts) == 1 {
+				return fmt.Errorf("%w: %v", errInput, err)
+			}
+			if args.Verbose {
+				fmt.Fprintln(os.Stderr, "Skipping", err)
+			}
+			imageContexts = append(imageContexts[:curImageContextIdx], imageContexts[curImageContextIdx+1:]...)
+			if curImageContextIdx >= len(imageContexts) {
+				curImageContextIdx = 0
+			}
+			renderedIdx = -1
+		}
+		if foreground && args.IfChanged && changedOnDisk(imageContexts[curImageContextIdx]) {
+			reloaded, err := loadImage(imageContexts[curImageContextIdx], args, screen_width, screen_height)
+			if err != nil {
+				// Possibly still being written, tried again next time
+				fmt.Fprintln(os.Stderr, err)
+			} else {
 				if args.Verbose {
-					fmt.Println("Image size before horizontal resizing:", wImg.Bounds())
+					fmt.Fprintln(os.Stderr, "Read", reloaded.path, "again as it changed")
 				}
-				wImg = imaging.Resize(wImg, screen_width, wImg.Bounds().Dy(), imaging.Lanczos)
-				if args.Verbose {
-					fmt.Println("Image size after resizing:", wImg.Bounds())
+				imageContexts[curImageContextIdx] = reloaded
+				renderedIdx = -1
+			}
+		}
+		if foreground {
+			if curImageContextIdx != renderedIdx {
+				if format.palette != nil {
+					format.palette.update(imageContexts[curImageContextIdx].image)
 				}
-			} else if transform == "vfit" {
+				// Composing covers the whole screen, background included
+				if !args.Compose {
+					if imageContexts[curImageContextIdx].background != nil {
+						drawImage(back.screenBuffer, imgContext{
+							image:        imageContexts[curImageContextIdx].background,
+							image_width:  screen_width,
+							image_height: screen_height,
+						})
+						back.markDirty(image.Rect(0, 0, screen_width, screen_height))
+					} else if !args.DontClear && !(args.ClearOnce && screenCleared) {
+						clearRect(back.screenBuffer, image.Rect(0, 0, screen_width, screen_height))
+						back.markDirty(image.Rect(0, 0, screen_width, screen_height))
+						screenCleared = true
+					} else {
+						// Only remove what we drew last, leaving the console alone
+						clearRect(back.screenBuffer, lastDrawn)
+						back.markDirty(lastDrawn)
+					}
+				}
+
 				if args.Verbose {
-					fmt.Println("Image size before vertical resizing:", wImg.Bounds())
+					fmt.Fprintln(os.Stderr, "Reading image:", curImageContextIdx)
+				}
+				renderStart := time.Now()
+				if args.Compose {
+					composeImage(back.screenBuffer, imageContexts[curImageContextIdx])
+				} else {
+					drawImage(back.screenBuffer, imageContexts[curImageContextIdx])
 				}
-				wImg = imaging.Resize(wImg, wImg.Bounds().Dx(), screen_height, imaging.Lanczos)
 				if args.Verbose {
-					fmt.Println("Image size after resizing:", wImg.Bounds())
+					fmt.Fprintln(os.Stderr, "Rendered in", time.Since(renderStart))
 				}
-			} else if transform == "center" {
-				imgWidth := wImg.Bounds().Max.X
-				imgHeight := wImg.Bounds().Max.Y
-				if imgWidth > screen_width {
-					imageContext.image_xoffset = (imgWidth - screen_width) / 2
-				} else if imgWidth < screen_width {
-					imageContext.screen_xoffset = (screen_width - imgWidth) / 2
+				lastDrawn = imageContexts[curImageContextIdx].screenRect()
+				if args.Border != nil {
+					lastDrawn = drawBorder(back.screenBuffer, lastDrawn, *args.Border)
 				}
-				if imgHeight > screen_height {
-					imageContext.image_yoffset = (imgHeight - screen_height) / 2
-				} else if imgHeight < screen_height {
-					imageContext.screen_yoffset = (screen_height - imgHeight) / 2
+				if imageContexts[curImageContextIdx].background != nil || args.Compose {
+					lastDrawn = image.Rect(0, 0, screen_width, screen_height)
 				}
-				if args.Verbose {
-					fmt.Println("Image size:", wImg.Bounds())
+				if args.Watermark.path != "" {
+					lastDrawn = lastDrawn.Union(drawWatermark(back.screenBuffer, &args.Watermark))
+				}
+				back.markDirty(lastDrawn)
+				renderedIdx = curImageContextIdx
+				if plays != nil {
+					if err := plays.show(imageContexts[curImageContextIdx].path); err != nil {
+						fmt.Fprintln(os.Stderr, err)
+					}
+				}
+
+				if args.ShowIndex {
+					showIndex()
+				}
+				if args.ShowInfo {
+					showInfo()
+				}
+			} else if args.IfChanged {
+				// Nothing changed, and the screen is left as it is
+			} else if !args.DontClear && !args.ClearOnce {
+				// Nothing changed, but the console may have written over us
+				back.markDirty(image.Rect(0, 0, screen_width, screen_height))
+			} else {
+				back.markDirty(lastDrawn)
+			}
+			if args.Clock {
+				lastClock = time.Now().Format(args.TimeFormat)
+				back.markDirty(drawOverlay(back.screenBuffer, renderText(lastClock), overlayTopRight))
+			}
+			if fading {
+				fading = false
+				fadeRect := image.Rect(0, 0, screen_width, screen_height)
+				if args.DontClear || args.ClearOnce {
+					fadeRect = lastDrawn
+				}
+				skip := func() bool {
+					select {
+					case event := <-keysEvents:
+						return event.Key == keyboard.KeyEsc
+					default:
+						return false
+					}
 				}
+				if err := fadeIn(back, fadeRect, time.Duration(args.FadeIn), flush, skip); err != nil {
+					return err
+				}
+			}
+			if err := flush(); err != nil {
+				return err
 			}
 		}
 
-		_, ok := wImg.At(0, 0).(color.NRGBA)
-		if !ok {
-			convertedImg := image.NewNRGBA(image.Rect(0, 0, wImg.Bounds().Dx(), wImg.Bounds().Dy()))
-			draw.Draw(convertedImg, convertedImg.Bounds(), wImg, wImg.Bounds().Min, draw.Src)
-			wImg = convertedImg
+		imageContext := imageContexts[curImageContextIdx]
+		redraw := imageContext.redraw * time.Duration(imageContext.weight)
+		animated := len(imageContext.frames) > 1
+		// Animations and the clock keep the last image on screen
+		hold := false
+		if args.Manual {
+			// Keys are the only way forward
+			hold = true
+		} else if args.Shuffle {
+			// There is no last image, only ones staying until a key is pressed
+			hold = redraw == 0
+		} else if len(imageContexts) == curImageContextIdx+1 {
+			if redraw == 0 {
+				if !args.Clock && !animated && pushes == nil && args.Timeout == 0 {
+					break
+				}
+				hold = true
+			}
+			if args.RepeatLast {
+				hold = true
+			}
 		}
 
-		imageContext.image = wImg
-		imageContext.image_width = wImg.Bounds().Max.X
-		if imageContext.image_width > screen_width {
-			imageContext.image_width = screen_width
+		sameImage := false
+		deadline := time.Now().Add(redraw)
+		// Animations counting loops move on once played enough, or after
+		// --loopmax, while still images keep using the timer
+		loopCounted := animated && args.LoopCount > 0 && !args.Manual && !(args.RepeatLast && len(imageContexts) == curImageContextIdx+1)
+		loops := 0
+		if loopCounted {
+			hold = args.LoopMax == 0
+			deadline = time.Now().Add(time.Duration(args.LoopMax))
 		}
-		imageContext.image_height = wImg.Bounds().Max.Y
-		if imageContext.image_height > screen_height {
-			imageContext.image_height = screen_height
+		frame := 0
+		var nextFrame time.Time
+		if animated {
+			nextFrame = time.Now().Add(frameDelay(imageContext.delays[frame], args.Fps))
 		}
-		if args.Verbose {
-			fmt.Println("y from", imageContext.image_yoffset, "to", imageContext.image_yoffset+imageContext.image_height, "x from", imageContext.image_xoffset, "to", imageContext.image_xoffset+imageContext.image_width)
-			fmt.Println("screen y from", imageContext.screen_yoffset, "screen x from", imageContext.screen_xoffset)
+		if !args.Preload && !args.Shuffle {
+			// Get the next image ready while this one is shown, failures are
+			// handled when its turn comes
+			loadOnly(imageContexts, []int{curImageContextIdx, (curImageContextIdx + 1) % len(imageContexts)}, args, screen_width, screen_height)
 		}
+	waiting:
+		for hold || time.Now().Before(deadline) {
+			if args.Timeout > 0 && !time.Now().Before(exitAt) {
+				return nil
+			}
+			if animated && foreground && !time.Now().Before(nextFrame) {
+				frame = (frame + 1) % len(imageContext.frames)
+				if frame == 0 && loopCounted {
+					loops++
+					if loops >= args.LoopCount {
+						break waiting
+					}
+				}
+				nextFrame = time.Now().Add(frameDelay(imageContext.delays[frame], args.Fps))
+				frameContext := imageContext
+				frameContext.image = imageContext.frames[frame]
+				if args.Compose {
+					composeImage(back.screenBuffer, frameContext)
+					if args.Border != nil {
+						drawBorder(back.screenBuffer, frameContext.screenRect(), *args.Border)
+					}
+				} else {
+					drawImage(back.screenBuffer, frameContext)
+				}
+				if args.Watermark.path != "" {
+					drawWatermark(back.screenBuffer, &args.Watermark)
+				}
+				back.markDirty(lastDrawn)
+				if args.ShowIndex {
+					showIndex()
+				}
+				if args.ShowInfo {
+					showInfo()
+				}
+				lastClock = ""
+			}
 
-		imageContexts = append(imageContexts, imageContext)
+			if args.Clock && foreground {
+				if now := time.Now().Format(args.TimeFormat); now != lastClock {
+					lastClock = now
+					back.markDirty(drawOverlay(back.screenBuffer, renderText(lastClock), overlayTopRight))
+				}
+			}
+			if err := flush(); err != nil {
+				return err
+			}
+
+			select {
+			case event := <-keysEvents:
+				if event.Key == keyboard.KeyEsc {
+					return nil
+				}
+				if event.Rune == 'f' {
+					toggledContext := &imageContexts[curImageContextIdx]
+					shown := toggledContext.transforms
+					if toggledContext.toggled == nil {
+						toggledContext.toggled = toggleTransforms(shown)
+					}
+					if err := toggledContext.retransform(toggledContext.toggled, args, screen_width, screen_height); err != nil {
+						fmt.Fprintln(os.Stderr, err)
+						break
+					}
+					// Never nil, which would mean not switched yet
+					toggledContext.toggled = append([]string{}, shown...)
+					renderedIdx = -1
+					sameImage = true
+					break waiting
+				}
+				if event.Rune == '#' {
+					args.ShowIndex = !args.ShowIndex
+					renderedIdx = -1
+					sameImage = true
+					break waiting
+				}
+				if args.Manual && (event.Key == keyboard.KeySpace || event.Key == keyboard.KeyArrowRight) &&
+					!(args.RepeatLast && len(imageContexts) == curImageContextIdx+1) {
+					break waiting
+				}
+				if event.Rune == 'i' {
+					args.ShowInfo = !args.ShowInfo
+					renderedIdx = -1
+					sameImage = true
+					break waiting
+				}
+				if string(event.Rune) == args.DeleteKey && args.Montage != nil {
+					fmt.Fprintln(os.Stderr, "Images of a montage cannot be deleted")
+				} else if string(event.Rune) == args.DeleteKey {
+					trashPath, err := trashImage(imageContext, args.TrashDir)
+					if err != nil {
+						fmt.Fprintln(os.Stderr, err)
+					} else {
+						if args.Verbose {
+							fmt.Fprintln(os.Stderr, "Moved", imageContext.path, "to", trashPath)
+						}
+						imageContexts = append(imageContexts[:curImageContextIdx], imageContexts[curImageContextIdx+1:]...)
+						if len(imageContexts) == 0 {
+							return nil
+						}
+						if curImageContextIdx >= len(imageContexts) {
+							curImageContextIdx = 0
+						}
+						// The next image already took this one's place
+						renderedIdx = -1
+						sameImage = true
+						break waiting
+					}
+				} else if event.Rune == 's' {
+					snapshotPath := filepath.Join(args.SnapshotDir, time.Now().Format("modernfbv-20060102-150405.000.png"))
+					if err := writePNG(snapshotPath, captureScreen(back.screenBuffer)); err != nil {
+						fmt.Fprintln(os.Stderr, err)
+					} else if args.Verbose {
+						fmt.Fprintln(os.Stderr, "Saved the screen to", snapshotPath)
+					}
+				}
+			case pushed := <-pushes:
+				pushedContext := newImgContext(pushed, args.Transform)
+				pushedContext.redraw = time.Duration(args.Redraw)
+				pushedContext, err := loadImage(pushedContext, args, screen_width, screen_height)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					break
+				}
+				imageContexts[curImageContextIdx] = pushedContext
+				renderedIdx = -1
+				sameImage = true
+				break waiting
+			case sig := <-vtSignals:
+				foreground = switcher.acknowledge(sig)
+				if foreground {
+					// The console was shown meanwhile, and is cleared again
+					screenCleared = false
+					renderedIdx = -1
+					sameImage = true
+					break waiting
+				}
+			default:
+			}
+
+			pause := time.Duration(args.PollInterval)
+			if animated && time.Until(nextFrame) < pause {
+				pause = time.Until(nextFrame)
+			}
+			if !hold && time.Until(deadline) < pause {
+				pause = time.Until(deadline)
+			}
+			if args.Timeout > 0 && time.Until(exitAt) < pause {
+				pause = time.Until(exitAt)
+			}
+			time.Sleep(pause)
+		}
+
+		if !sameImage && args.Shuffle {
+			curImageContextIdx = pickWeighted(imageContexts, curImageContextIdx)
+		} else if !sameImage {
+			curImageContextIdx++
+			if curImageContextIdx >= len(imageContexts) {
+				curImageContextIdx = 0
+			}
+		}
+	}
+	return nil
+}
+
+// How long an animation frame stays, no shorter than the frame rate limit allows.
+func frameDelay(delay time.Duration, fps int) time.Duration {
+	if fps > 0 && delay < time.Second/time.Duration(fps) {
+		return time.Second / time.Duration(fps)
+	}
+	return delay
+}
+
+// Pick a random image other than the current one, in proportion to their weights.
+func pickWeighted(imageContexts []imgContext, current int) int {
+	total := 0
+	for i, imageContext := range imageContexts {
+		if i != current {
+			total += imageContext.weight
+		}
+	}
+	if total == 0 {
+		return current
+	}
+	pick := rand.Intn(total)
+	for i, imageContext := range imageContexts {
+		if i == current {
+			continue
+		}
+		if pick < imageContext.weight {
+			return i
+		}
+		pick -= imageContext.weight
 	}
+	return current
+}
+
+const (
+	alignStart  = -1
+	alignMiddle = 0
+	alignEnd    = 1
+)
+
+// Where an image is anchored when it does not exactly match the screen.
+// The zero value keeps it centered.
+type alignment struct {
+	horizontal int
+	vertical   int
+}
+
+// Accepts top, bottom, left, right, center or combinations such as "bottom-left" or "top,right".
+func (align *alignment) UnmarshalText(text []byte) error {
+	*align = alignment{}
+	for _, anchor := range strings.FieldsFunc(string(text), func(r rune) bool { return r == '-' || r == ',' }) {
+		switch anchor {
+		case "top":
+			align.vertical = alignStart
+		case "bottom":
+			align.vertical = alignEnd
+		case "left":
+			align.horizontal = alignStart
+		case "right":
+			align.horizontal = alignEnd
+		case "center":
+		default:
+			return fmt.Errorf("unknown alignment: %s", anchor)
+		}
+	}
+	return nil
+}
+
+// Share of the screen, given as 80% or 80, kept as a fraction.
+type percent float64
+
+func (value *percent) UnmarshalText(text []byte) error {
+	number, err := strconv.ParseFloat(strings.TrimSuffix(string(text), "%"), 64)
+	if err != nil || number <= 0 || number > 100 {
+		return fmt.Errorf("invalid size: %s, expected a percentage of the screen up to 100, as in 80%%", text)
+	}
+	*value = percent(number / 100)
+	return nil
+}
+
+// Duration given in Go syntax, as in 500ms or 2s, or as a bare number of seconds.
+type interval time.Duration
+
+func (value *interval) UnmarshalText(text []byte) error {
+	duration, err := parseInterval(string(text))
+	if err != nil {
+		return err
+	}
+	if duration < 0 {
+		return fmt.Errorf("negative duration: %s", text)
+	}
+	*value = interval(duration)
+	return nil
+}
+
+func parseInterval(text string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(text); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(text)
+}
+
+// Screen size and depth forced from the command line or the environment.
+type geometry struct {
+	width  int
+	height int
+	depth  int
+}
 
-	screenPixels, err := syscall.Mmap(
+// Accepts WxHxBPP, as in 1920x1080x32, or WxH at 32 bits per pixel.
+func (geom *geometry) UnmarshalText(text []byte) error {
+	var extra string
+	n, _ := fmt.Sscanf(string(text), "%dx%dx%d%s", &geom.width, &geom.height, &geom.depth, &extra)
+	if n == 2 && strings.Count(string(text), "x") == 1 {
+		geom.depth = 32
+		n = 3
+	}
+	if n != 3 || geom.width <= 0 || geom.height <= 0 {
+		return fmt.Errorf("invalid geometry: %s, expected WxHxBPP", text)
+	}
+	if _, ok := depthFormats[uint32(geom.depth)]; !ok {
+		return fmt.Errorf("unsupported depth: %d bits per pixel", geom.depth)
+	}
+	return nil
+}
+
+// Region of the screen given as x,y,w,h.
+type viewport image.Rectangle
+
+func (view *viewport) UnmarshalText(text []byte) error {
+	var x, y, width, height int
+	var extra string
+	n, _ := fmt.Sscanf(string(text), "%d,%d,%d,%d%s", &x, &y, &width, &height, &extra)
+	if n != 4 || x < 0 || y < 0 || width <= 0 || height <= 0 {
+		return fmt.Errorf("invalid viewport: %s, expected x,y,w,h", text)
+	}
+	*view = viewport(image.Rect(x, y, x+width, y+height))
+	return nil
+}
+
+// Offset within a free (or cropped) span for an anchor. When centering an odd
+// span, division truncating towards zero leaves the extra pixel at the end,
+// be it margin or cropped part, and both sides always add up to the span.
+func alignOffset(span int, anchor int) int {
+	return span * (anchor + 1) / 2
+}
+
+// Place an image along one axis: the image's anchor point lands on the screen's.
+// Returns where reading the image starts (cropping) and where it lands on screen (letterboxing).
+func centerAxis(imgSize int, screenSize int, anchor int) (int, int) {
+	offset := alignOffset(screenSize-imgSize, anchor)
+	if offset < 0 {
+		return -offset, 0
+	}
+	return 0, offset
+}
+
+func centerImage(imageContext *imgContext, img image.Image, screen_width int, screen_height int, align alignment) {
+	imageContext.image_xoffset, imageContext.screen_xoffset = centerAxis(img.Bounds().Dx(), screen_width, align.horizontal)
+	imageContext.image_yoffset, imageContext.screen_yoffset = centerAxis(img.Bounds().Dy(), screen_height, align.vertical)
+}
+
+// Largest size preserving the image's aspect ratio that fits on screen.
+func autofitSize(imgWidth int, imgHeight int, screen_width int, screen_height int) (int, int) {
+	// Compare screen_width/imgWidth to screen_height/imgHeight without rounding
+	if screen_width*imgHeight <= screen_height*imgWidth {
+		return screen_width, imgHeight * screen_width / imgWidth
+	}
+	return imgWidth * screen_height / imgHeight, screen_height
+}
+
+// Largest centered part of the image with the screen's aspect ratio, at
+// least a pixel wide and high however thin the image.
+func cropToAspectSize(imgWidth int, imgHeight int, screen_width int, screen_height int) (int, int) {
+	width, height := imgWidth, imgWidth*screen_height/screen_width
+	if screen_width*imgHeight <= screen_height*imgWidth {
+		// Wider than the screen: keep the height
+		width, height = imgHeight*screen_width/screen_height, imgHeight
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	return width, height
+}
+
+// Size an image dimension should be resized to, possibly refusing to enlarge it.
+func resizeTarget(current int, target int, noUpscale bool) int {
+	if noUpscale && current < target {
+		return current
+	}
+	return target
+}
+
+// Map the framebuffer memory, returning its visible part along with the
+// whole mapping to unmap later.
+func mapScreen(fbF *os.File, screeninfo fb_var_screeninfo, format pixelFormat, headerSize int) (screenBuffer, []byte, error) {
+	screen := screenBuffer{
+		width:  int(screeninfo.xres),
+		height: int(screeninfo.yres),
+		// Pixels per line in memory, wider than the screen when panning horizontally
+		stride: int(screeninfo.xres_virtual),
+		format: format,
+	}
+	if screen.stride < screen.width {
+		screen.stride = screen.width
+	}
+	// The driver knows better, as lines may be padded past the virtual width
+	var fixinfo fb_fix_screeninfo
+	hasFixInfo := getFixScreenInfo(fbF, &fixinfo) == nil
+	if hasFixInfo && fixinfo.line_length > 0 && int(fixinfo.line_length)%format.bytes == 0 && int(fixinfo.line_length) >= screen.width*format.bytes {
+		screen.stride = int(fixinfo.line_length) / format.bytes
+	}
+
+	// Pixels start after the header some devices reserve, see --fboffset
+	visibleOffset := headerSize + screen.offset(int(screeninfo.xoffset), int(screeninfo.yoffset))
+	// The padding after the last line may be past the end of the memory when panned
+	neededSize := visibleOffset + screen.offset(screen.width, screen.height-1)
+	mappedSize := visibleOffset + screen.stride*screen.height*format.bytes
+	if hasFixInfo && fixinfo.smem_len > 0 {
+		if neededSize > int(fixinfo.smem_len) {
+			return screen, nil, fmt.Errorf("the screen at offset %d needs %d bytes, more than the %d bytes of framebuffer memory", visibleOffset, neededSize, fixinfo.smem_len)
+		}
+		if mappedSize > int(fixinfo.smem_len) {
+			mappedSize = int(fixinfo.smem_len)
+		}
+	}
+	mappedPixels, err := syscall.Mmap(
 		int(fbF.Fd()),
 		0,
-		screen_width*screen_height*bpp,
+		mappedSize,
 		syscall.PROT_READ|syscall.PROT_WRITE,
 		syscall.MAP_SHARED)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return screen, nil, err
 	}
-	defer syscall.Munmap(screenPixels)
+	screen.pixels = mappedPixels[visibleOffset:]
+	return screen, mappedPixels, nil
+}
 
-	keysEvents, err := keyboard.GetKeys(1)
+// Some kernels accept a writable mapping but fault (SIGBUS) on the first write.
+func probeWrite(screenPixels []byte) error {
+	return writeGuarded(func() {
+		value := screenPixels[0]
+		screenPixels[0] = value
+	})
+}
+
+// Open the framebuffer device and get its screen information, as given by
+// --geometry or queried from the driver, then rotate it as asked.
+// Also returns the screen information from before the rotation.
+func openScreen(args args, screeninfo *fb_var_screeninfo) (*os.File, fb_var_screeninfo, error) {
+	query := screeninfo
+	if args.Geometry != nil {
+		// The driver's answer cannot be trusted, for instance in some containers
+		screeninfo.xres = uint32(args.Geometry.width)
+		screeninfo.yres = uint32(args.Geometry.height)
+		screeninfo.xres_virtual = screeninfo.xres
+		screeninfo.yres_virtual = screeninfo.yres
+		screeninfo.bits_per_pixel = uint32(args.Geometry.depth)
+		query = nil
+	}
+	fbF, err := openFramebuffer(args.DevicePath, query, time.Duration(args.WaitForFb)*time.Second, args.Verbose)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return nil, *screeninfo, fmt.Errorf("%w: %v", errDevice, err)
 	}
-	defer func() {
-		_ = keyboard.Close()
-	}()
+	original := *screeninfo
 
-	curImageContextIdx := 0
+	if args.RotateScreen != 0 {
+		rotate, ok := screenRotations[args.RotateScreen]
+		if !ok {
+			fbF.Close()
+			return nil, original, fmt.Errorf("%w: unsupported screen rotation: %d", errUsage, args.RotateScreen)
+		}
+		screeninfo.rotate = rotate
+		// Width and height may get swapped
+		err = putScreenInfo(fbF, screeninfo, false)
+		if err != nil {
+			fbF.Close()
+			return nil, original, fmt.Errorf("%w: cannot rotate the screen: %v", errDevice, err)
+		}
+	}
+	return fbF, original, nil
+}
+
+// Open the framebuffer device and query its screen information, retrying
+// with an increasing delay until it succeeds or the wait time is over.
+// A nil screeninfo skips the query.
+func openFramebuffer(devicePath string, screeninfo *fb_var_screeninfo, wait time.Duration, verbose bool) (*os.File, error) {
+	deadline := time.Now().Add(wait)
+	backoff := 100 * time.Millisecond
 	for {
-		if !args.DontClear {
-			for i := 0; i < screen_height*screen_width*4; i++ {
-				screenPixels[i] = 0
+		fbF, err := os.OpenFile(devicePath, os.O_RDWR, os.ModeDevice)
+		if err == nil {
+			if screeninfo != nil {
+				err = getScreenInfo(fbF, screeninfo)
+			}
+			if err == nil {
+				return fbF, nil
 			}
+			fbF.Close()
 		}
 
-		if args.Verbose {
-			fmt.Println("Reading image:", curImageContextIdx)
+		if time.Now().Add(backoff).After(deadline) {
+			return nil, err
 		}
-		imageContext := imageContexts[curImageContextIdx]
+		if verbose {
+			fmt.Fprintln(os.Stderr, "Framebuffer not ready, retrying in", backoff, ":", err)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > 2*time.Second {
+			backoff = 2 * time.Second
+		}
+	}
+}
 
-		curPixelBit := (imageContext.screen_yoffset*screen_width + imageContext.screen_xoffset) * 4
-		for y := imageContext.image_yoffset; y < imageContext.image_yoffset+imageContext.image_height; y++ {
-			for x := imageContext.image_xoffset; x < imageContext.image_xoffset+imageContext.image_width; x++ {
-				pixColor := imageContext.image.At(x, y)
-				pixColorBits := pixColor.(color.NRGBA)
-				screenPixels[curPixelBit] = pixColorBits.B
-				curPixelBit++
-				screenPixels[curPixelBit] = pixColorBits.G
-				curPixelBit++
-				screenPixels[curPixelBit] = pixColorBits.R
-				curPixelBit++
-				screenPixels[curPixelBit] = pixColorBits.A
-				curPixelBit++
-			}
-			if screen_width > imageContext.image_width {
-				curPixelBit += (screen_width - imageContext.image_width) * 4
-			}
+func getFixScreenInfo(fbF *os.File, fixinfo *fb_fix_screeninfo) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fbF.Fd(), FBIOGET_FSCREENINFO, uintptr(unsafe.Pointer(fixinfo)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func getScreenInfo(fbF *os.File, screeninfo *fb_var_screeninfo) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fbF.Fd(), FBIOGET_VSCREENINFO, uintptr(unsafe.Pointer(screeninfo)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Apply the screen information now, then read it back into screeninfo:
+// some drivers accept the request without changing anything.
+func putScreenInfo(fbF *os.File, screeninfo *fb_var_screeninfo, force bool) error {
+	request := *screeninfo
+	request.activate = FB_ACTIVATE_NOW
+	if force {
+		request.activate |= FB_ACTIVATE_FORCE
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fbF.Fd(), FBIOPUT_VSCREENINFO, uintptr(unsafe.Pointer(&request)))
+	if errno != 0 {
+		return errno
+	}
+	err := getScreenInfo(fbF, screeninfo)
+	if err != nil {
+		return err
+	}
+	if screeninfo.rotate != request.rotate || screeninfo.bits_per_pixel != request.bits_per_pixel {
+		return errors.New("mode not applied by the driver")
+	}
+	return nil
+}
+
+var fitTransforms = map[string]bool{"stretch": true, "fit": true, "hfit": true, "vfit": true, "autofit": true}
+
+// Transforms 'f' switches an image to: actual size if its transforms fit it
+// to the screen, and fitted otherwise.
+func toggleTransforms(transforms []string) []string {
+	for _, transform := range transforms {
+		if fitTransforms[transform] {
+			return []string{"center"}
 		}
+	}
+	return []string{"autofit", "center"}
+}
 
-		if len(imageContexts) == curImageContextIdx+1 {
-			if args.Redraw == 0 {
-				break
-			}
+// Area of the screen covered by an image.
+func (imageContext imgContext) screenRect() image.Rectangle {
+	return image.Rect(
+		imageContext.screen_xoffset,
+		imageContext.screen_yoffset,
+		imageContext.screen_xoffset+imageContext.image_width,
+		imageContext.screen_yoffset+imageContext.image_height)
+}
+
+func clearRect(screen screenBuffer, rect image.Rectangle) {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		lineStart := screen.offset(rect.Min.X, y)
+		for i := lineStart; i < lineStart+rect.Dx()*screen.format.bytes; i++ {
+			screen.pixels[i] = 0
 		}
-		curImageContextIdx++
-		if curImageContextIdx >= len(imageContexts) {
-			curImageContextIdx = 0
+	}
+}
+
+func drawImage(screen screenBuffer, imageContext imgContext) {
+	if nrgba, ok := imageContext.image.(*image.NRGBA); ok && imageContext.opaque {
+		// Nothing to blend: whole lines go straight from the image's memory
+		for y := 0; y < imageContext.image_height; y++ {
+			lineStart := nrgba.PixOffset(imageContext.image_xoffset, imageContext.image_yoffset+y)
+			screen.format.packOpaque(screen.pixels[screen.offset(imageContext.screen_xoffset, imageContext.screen_yoffset+y):],
+				nrgba.Pix[lineStart:lineStart+4*imageContext.image_width])
+		}
+		return
+	}
+	for y := 0; y < imageContext.image_height; y++ {
+		curPixelBit := screen.offset(imageContext.screen_xoffset, imageContext.screen_yoffset+y)
+		for x := imageContext.image_xoffset; x < imageContext.image_xoffset+imageContext.image_width; x++ {
+			pixColor := imageContext.image.At(x, imageContext.image_yoffset+y)
+			pixColorBits := pixColor.(color.NRGBA)
+			if pixColorBits.A < 255 && imageContext.background != nil {
+				pixColorBits = screen.blend(pixColorBits, imageContext.background.At(
+					imageContext.screen_xoffset+x-imageContext.image_xoffset, imageContext.screen_yoffset+y).(color.NRGBA))
+			}
+			screen.format.pack(screen.pixels[curPixelBit:], pixColorBits)
+			curPixelBit += screen.format.bytes
 		}
+	}
+}
 
-		for sleeper := 0; sleeper < args.Redraw*10; sleeper++ {
-			select {
-			case event := <-keysEvents:
-				if event.Key == keyboard.KeyEsc {
-					return
+// Draw an image over its background on a screen-sized canvas, then convert
+// the canvas as a whole, rather than drawing the image at its offsets.
+func composeImage(screen screenBuffer, imageContext imgContext) {
+	canvas := image.NewNRGBA(image.Rect(0, 0, screen.width, screen.height))
+	op := draw.Src
+	if imageContext.background != nil {
+		draw.Draw(canvas, canvas.Bounds(), imageContext.background, image.Point{}, draw.Src)
+		op = draw.Over
+	}
+	if op == draw.Over && screen.linear {
+		// The image package only blends in sRGB
+		rect := imageContext.screenRect()
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				pixColorBits := imageContext.image.At(imageContext.image_xoffset+x-rect.Min.X, imageContext.image_yoffset+y-rect.Min.Y).(color.NRGBA)
+				if pixColorBits.A < 255 {
+					pixColorBits = blendOverLinear(pixColorBits, canvas.NRGBAAt(x, y))
 				}
-			default:
+				canvas.SetNRGBA(x, y, pixColorBits)
 			}
+		}
+	} else {
+		draw.Draw(canvas, imageContext.screenRect(), imageContext.image,
+			image.Pt(imageContext.image_xoffset, imageContext.image_yoffset), op)
+	}
 
-			time.Sleep(100 * time.Millisecond)
+	for y := 0; y < canvas.Rect.Dy(); y++ {
+		row := canvas.Pix[y*canvas.Stride:]
+		curPixelBit := screen.offset(0, y)
+		for x := 0; x < canvas.Rect.Dx(); x++ {
+			screen.format.pack(screen.pixels[curPixelBit:], color.NRGBA{row[4*x], row[4*x+1], row[4*x+2], row[4*x+3]})
+			curPixelBit += screen.format.bytes
 		}
 	}
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+func TestCenterImage(t *testing.T) {
+	tests := []struct {
+		name                     string
+		imgWidth, imgHeight      int
+		wantImageX, wantImageY   int
+		wantScreenX, wantScreenY int
+	}{
+		{"larger on both axes", 400, 300, 40, 30, 0, 0},
+		{"smaller on both axes", 200, 100, 0, 0, 60, 70},
+		{"exact size", 320, 240, 0, 0, 0, 0},
+		{"wider, shorter", 400, 100, 40, 0, 0, 70},
+		{"narrower, taller", 200, 300, 0, 30, 60, 0},
+		{"exact width, taller", 320, 300, 0, 30, 0, 0},
+		{"exact height, narrower", 200, 240, 0, 0, 60, 0},
+	}
+	for _, test := range tests {
+		var imageContext imgContext
+		centerImage(&imageContext, image.NewNRGBA(image.Rect(0, 0, test.imgWidth, test.imgHeight)), 320, 240, alignment{})
+		if imageContext.image_xoffset != test.wantImageX || imageContext.image_yoffset != test.wantImageY ||
+			imageContext.screen_xoffset != test.wantScreenX || imageContext.screen_yoffset != test.wantScreenY {
+			t.Errorf("%s: image read from %d,%d and drawn at %d,%d, want %d,%d and %d,%d", test.name,
+				imageContext.image_xoffset, imageContext.image_yoffset, imageContext.screen_xoffset, imageContext.screen_yoffset,
+				test.wantImageX, test.wantImageY, test.wantScreenX, test.wantScreenY)
+		}
+	}
+}
+
+func TestCenterAxisOddSizes(t *testing.T) {
+	tests := []struct {
+		imgSize, screenSize, anchor int
+		wantLeading                 int
+	}{
+		{101, 320, alignMiddle, 109},
+		{100, 321, alignMiddle, 110},
+		{101, 321, alignMiddle, 110},
+		{321, 100, alignMiddle, 110},
+		{320, 101, alignMiddle, 109},
+		{101, 321, alignStart, 0},
+		{101, 321, alignEnd, 220},
+		{321, 101, alignStart, 0},
+		{321, 101, alignEnd, 220},
+		{1, 2, alignMiddle, 0},
+		{2, 1, alignMiddle, 0},
+	}
+	for _, test := range tests {
+		imageOffset, screenOffset := centerAxis(test.imgSize, test.screenSize, test.anchor)
+		// Letterboxed, the margins are on screen; cropped, they are cut off the image
+		span, leading := test.screenSize-test.imgSize, screenOffset
+		if span < 0 {
+			span, leading = -span, imageOffset
+		}
+		trailing := span - leading
+		if leading != test.wantLeading || leading < 0 || trailing < 0 || leading+trailing != span {
+			t.Errorf("%d on %d anchored at %d: margins %d and %d, want %d and %d", test.imgSize, test.screenSize, test.anchor,
+				leading, trailing, test.wantLeading, span-test.wantLeading)
+		}
+		if imageOffset != 0 && screenOffset != 0 {
+			t.Errorf("%d on %d anchored at %d: both cropped at %d and moved by %d", test.imgSize, test.screenSize, test.anchor,
+				imageOffset, screenOffset)
+		}
+		if test.anchor == alignMiddle && (trailing-leading < 0 || trailing-leading > 1) {
+			t.Errorf("%d on %d: centered off by more than the odd pixel, %d and %d", test.imgSize, test.screenSize, leading, trailing)
+		}
+	}
+}
+
+func TestCropToAspectSize(t *testing.T) {
+	tests := []struct {
+		name                      string
+		imgWidth, imgHeight       int
+		screenWidth, screenHeight int
+		wantWidth, wantHeight     int
+	}{
+		{"landscape wider than the screen", 4000, 1000, 320, 240, 1333, 1000},
+		{"landscape taller than the screen", 1200, 1000, 320, 240, 1200, 900},
+		{"portrait on a landscape screen", 1000, 4000, 320, 240, 1000, 750},
+		{"landscape on a portrait screen", 1000, 500, 240, 320, 375, 500},
+		{"portrait on a portrait screen", 600, 1000, 240, 320, 600, 800},
+		{"same aspect ratio", 640, 480, 320, 240, 640, 480},
+		{"thin portrait", 1, 1000, 320, 240, 1, 1},
+		{"thin landscape", 1000, 1, 240, 320, 1, 1},
+	}
+	for _, test := range tests {
+		width, height := cropToAspectSize(test.imgWidth, test.imgHeight, test.screenWidth, test.screenHeight)
+		if width != test.wantWidth || height != test.wantHeight {
+			t.Errorf("%s: %dx%d on %dx%d cropped to %dx%d, want %dx%d", test.name,
+				test.imgWidth, test.imgHeight, test.screenWidth, test.screenHeight, width, height, test.wantWidth, test.wantHeight)
+		}
+		if width > test.imgWidth || height > test.imgHeight {
+			t.Errorf("%s: %dx%d is larger than the %dx%d image", test.name, width, height, test.imgWidth, test.imgHeight)
+		}
+	}
+}
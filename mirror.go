@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/disintegration/imaging"
+)
+
+// Second framebuffer showing a copy of the first one, scaled and repacked
+// for its own resolution and pixel format.
+type mirrorScreen struct {
+	fbF          *os.File
+	mappedPixels []byte
+	screen       screenBuffer
+}
+
+func openMirror(devicePath string, noAlpha bool) (*mirrorScreen, error) {
+	fbF, err := os.OpenFile(devicePath, os.O_RDWR, os.ModeDevice)
+	if err != nil {
+		return nil, err
+	}
+	screeninfo := fb_var_screeninfo{}
+	err = getScreenInfo(fbF, &screeninfo)
+	if err == nil && (screeninfo.xres == 0 || screeninfo.yres == 0) {
+		err = fmt.Errorf("%s does not appear to be active", devicePath)
+	}
+	if _, ok := depthFormats[screeninfo.bits_per_pixel]; err == nil && (!ok || screeninfo.bits_per_pixel == 8) {
+		err = fmt.Errorf("%s: unsupported depth of %d bits per pixel", devicePath, screeninfo.bits_per_pixel)
+	}
+	if err != nil {
+		fbF.Close()
+		return nil, err
+	}
+
+	format := detectPixelFormat(screeninfo)
+	format.opaque = noAlpha
+	screen, mappedPixels, err := mapScreen(fbF, screeninfo, format, 0)
+	if err != nil {
+		fbF.Close()
+		return nil, err
+	}
+	return &mirrorScreen{fbF: fbF, mappedPixels: mappedPixels, screen: screen}, nil
+}
+
+// Copy what the primary screen shows.
+func (mirror *mirrorScreen) update(primary screenBuffer) {
+	scaled := imaging.Resize(captureScreen(primary), mirror.screen.width, mirror.screen.height, imaging.Linear)
+	drawImage(mirror.screen, imgContext{
+		image:        scaled,
+		image_width:  mirror.screen.width,
+		image_height: mirror.screen.height,
+	})
+}
+
+func (mirror *mirrorScreen) close() {
+	syscall.Munmap(mirror.mappedPixels)
+	mirror.fbF.Close()
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Print the modes the screen supports, as the kernel lists them in sysfs:
+// for a framebuffer device in /sys/class/graphics/fbN/modes, and for a DRM
+// card in the modes of each of its connectors.
+func listModes(args args) error {
+	devicePath, err := filepath.EvalSymlinks(args.DevicePath)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errDevice, err)
+	}
+	device := filepath.Base(devicePath)
+	sysDirs := []string{filepath.Join("/sys/class/graphics", device)}
+	if args.Backend == "drm" {
+		sysDirs, _ = filepath.Glob(filepath.Join("/sys/class/drm", device+"-*"))
+	}
+	listed := false
+	for _, sysDir := range sysDirs {
+		modes, err := os.ReadFile(filepath.Join(sysDir, "modes"))
+		if err != nil {
+			continue
+		}
+		listed = true
+		details := ""
+		if mode, err := os.ReadFile(filepath.Join(sysDir, "mode")); err == nil && len(mode) > 0 {
+			details = " (current: " + strings.TrimSpace(string(mode)) + ")"
+		}
+		if status, err := os.ReadFile(filepath.Join(sysDir, "status")); err == nil {
+			details += " " + strings.TrimSpace(string(status))
+		}
+		fmt.Printf("%s%s:\n", filepath.Base(sysDir), details)
+		if len(strings.TrimSpace(string(modes))) == 0 {
+			fmt.Println("  no modes reported")
+		}
+		for _, mode := range strings.Fields(string(modes)) {
+			fmt.Println(" ", mode)
+		}
+	}
+	if !listed {
+		return fmt.Errorf("%w: %s does not list its modes in /sys/class", errDevice, args.DevicePath)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"path/filepath"
+	"strings"
+)
+
+// Columns and rows of --montage, given as CxR.
+type grid struct {
+	columns int
+	rows    int
+}
+
+func (layout *grid) UnmarshalText(text []byte) error {
+	var extra string
+	n, _ := fmt.Sscanf(string(text), "%dx%d%s", &layout.columns, &layout.rows, &extra)
+	if n != 2 || layout.columns <= 0 || layout.rows <= 0 {
+		return fmt.Errorf("invalid montage: %s, expected CxR as in 2x2", text)
+	}
+	return nil
+}
+
+// Load the images and lay them out in the grid cells, left to right then top
+// to bottom, each fitted and centered in its cell. Every screenful becomes a
+// single screen-sized image, shown as one slide.
+func loadMontage(sources []imgContext, args args, screen_width int, screen_height int, progress func(loaded int, total int)) ([]imgContext, error) {
+	layout := *args.Montage
+	cell_width, cell_height := screen_width/layout.columns, screen_height/layout.rows
+	cells := make([]imgContext, len(sources))
+	for i, source := range sources {
+		// Rotations still apply, the cell decides the size and placement
+		cells[i] = source
+		cells[i].transforms = nil
+		for _, transform := range source.transforms {
+			if !fitTransforms[transform] && transform != "center" {
+				cells[i].transforms = append(cells[i].transforms, transform)
+			}
+		}
+		cells[i].transforms = append(cells[i].transforms, "autofit", "center")
+	}
+	loaded, err := loadImages(cells, args, cell_width, cell_height, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	pageSize := layout.columns * layout.rows
+	pages := []imgContext{}
+	for first := 0; first < len(loaded); first += pageSize {
+		canvas := image.NewNRGBA(image.Rect(0, 0, screen_width, screen_height))
+		if args.BgImage.image != nil {
+			// Behind the whole grid rather than each cell
+			draw.Draw(canvas, canvas.Bounds(), args.BgImage.image, image.Point{}, draw.Src)
+		}
+		names := []string{}
+		for i := first; i < first+pageSize && i < len(loaded); i++ {
+			cell := loaded[i]
+			cellOrigin := image.Pt((i-first)%layout.columns*cell_width, (i-first)/layout.columns*cell_height)
+			if cell.background != nil && args.BgImage.image == nil {
+				draw.Draw(canvas, image.Rectangle{cellOrigin, cellOrigin.Add(image.Pt(cell_width, cell_height))},
+					cell.background, image.Point{}, draw.Src)
+			}
+			draw.Draw(canvas, cell.screenRect().Add(cellOrigin), cell.image,
+				image.Pt(cell.image_xoffset, cell.image_yoffset), draw.Over)
+			names = append(names, filepath.Base(cell.path))
+		}
+		pages = append(pages, imgContext{
+			path:         "montage of " + strings.Join(names, ", "),
+			redraw:       loaded[first].redraw,
+			weight:       1,
+			image:        canvas,
+			decoded:      []image.Image{canvas},
+			format:       "montage",
+			image_width:  screen_width,
+			image_height: screen_height,
+		})
+	}
+	return pages, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"image"
+	"io"
+
+	"github.com/disintegration/imaging"
+)
+
+// EXIF orientation of a JPEG photo, 1 (upright) when missing.
+// See https://www.cipa.jp/std/documents/e/DC-008-2012_E.pdf
+func readOrientation(r io.Reader) int {
+	reader := bufio.NewReader(r)
+	marker := make([]byte, 4)
+	if _, err := io.ReadFull(reader, marker[:2]); err != nil || marker[0] != 0xff || marker[1] != 0xd8 {
+		return 1
+	}
+	for {
+		if _, err := io.ReadFull(reader, marker); err != nil || marker[0] != 0xff {
+			return 1
+		}
+		// Start of scan: no more metadata
+		if marker[1] == 0xda {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if length < 0 {
+			return 1
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(reader, segment); err != nil {
+			return 1
+		}
+		if marker[1] == 0xe1 && len(segment) > 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return exifOrientation(segment[6:])
+		}
+	}
+}
+
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if string(tiff[:2]) == "II" {
+		order = binary.LittleEndian
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 0 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + 12*i
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// Turn an image upright according to its EXIF orientation.
+func orient(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	}
+	return img
+}
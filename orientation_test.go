@@ -0,0 +1,60 @@
+//go:build jpeg || !(png || gif || bmp || webp || tiff || qoi || ico)
+
+package main
+
+import (
+	"image/color"
+	"testing"
+)
+
+// Whether a decoded JPEG pixel is close to the expected color.
+func nearColor(got color.Color, want color.NRGBA) bool {
+	r, g, b, _ := got.RGBA()
+	near := func(value uint32, want uint8) bool {
+		diff := int(value>>8) - int(want)
+		return diff > -24 && diff < 24
+	}
+	return near(r, want.R) && near(g, want.G) && near(b, want.B)
+}
+
+// The fixture is stored as a 16x8 landscape, red on the left and blue on the
+// right, with EXIF orientation 6: upright, it is an 8x16 portrait with red at
+// the top. rotate90 then turns it clockwise, blue coming to the left.
+func TestAutoOrientThenRotate(t *testing.T) {
+	const fixture = "testdata/exif-orientation6.jpg"
+	red, blue := color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 0, 255, 255}
+
+	args := args{AutoOrient: true, Fill: "none"}
+	uprightContext, err := loadImage(imgContext{path: fixture, transforms: []string{}, weight: 1}, args, 100, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upright := uprightContext.image
+	if upright.Bounds().Dx() != 8 || upright.Bounds().Dy() != 16 {
+		t.Fatalf("upright size %v, want 8x16", upright.Bounds().Size())
+	}
+	if !nearColor(upright.At(4, 2), red) || !nearColor(upright.At(4, 13), blue) {
+		t.Errorf("upright image has %v at the top and %v at the bottom, want red and blue", upright.At(4, 2), upright.At(4, 13))
+	}
+
+	rotatedContext, err := loadImage(imgContext{path: fixture, transforms: []string{"rotate90"}, weight: 1}, args, 100, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated := rotatedContext.image
+	if rotated.Bounds().Dx() != 16 || rotated.Bounds().Dy() != 8 {
+		t.Fatalf("rotated size %v, want 16x8", rotated.Bounds().Size())
+	}
+	if !nearColor(rotated.At(2, 4), blue) || !nearColor(rotated.At(13, 4), red) {
+		t.Errorf("rotated image has %v at the left and %v at the right, want blue and red", rotated.At(2, 4), rotated.At(13, 4))
+	}
+
+	args.AutoOrient = false
+	asStored, err := loadImage(imgContext{path: fixture, transforms: []string{}, weight: 1}, args, 100, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if asStored.image.Bounds().Dx() != 16 {
+		t.Errorf("without --autoorient the image is %v, want it as stored, 16x8", asStored.image.Bounds().Size())
+	}
+}
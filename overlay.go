@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const overlayMargin = 8
+const overlayPadding = 4
+
+const (
+	overlayTopLeft = iota
+	overlayTopRight
+	overlayBottomLeft
+	overlayBottomRight
+)
+
+// Render a short line of text, white on black, using the built-in bitmap font.
+func renderText(text string) *image.NRGBA {
+	face := basicfont.Face7x13
+	textWidth := font.MeasureString(face, text).Ceil()
+	textHeight := face.Metrics().Height.Ceil()
+
+	img := image.NewNRGBA(image.Rect(0, 0, textWidth+2*overlayPadding, textHeight+2*overlayPadding))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.NRGBA{0, 0, 0, 255}), image.Point{}, draw.Src)
+
+	drawer := font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(color.NRGBA{255, 255, 255, 255}),
+		Face: face,
+		Dot:  fixed.P(overlayPadding, overlayPadding+face.Metrics().Ascent.Ceil()),
+	}
+	drawer.DrawString(text)
+	return img
+}
+
+// Area of a width x height overlay in a corner of the screen, empty when it does not fit.
+func overlayRect(screen screenBuffer, width int, height int, corner int) image.Rectangle {
+	xoffset, yoffset := overlayMargin, overlayMargin
+	if corner == overlayTopRight || corner == overlayBottomRight {
+		xoffset = screen.width - width - overlayMargin
+	}
+	if corner == overlayBottomLeft || corner == overlayBottomRight {
+		yoffset = screen.height - height - overlayMargin
+	}
+	if xoffset < 0 || yoffset < 0 || xoffset+width > screen.width || yoffset+height > screen.height {
+		return image.Rectangle{}
+	}
+	return image.Rect(xoffset, yoffset, xoffset+width, yoffset+height)
+}
+
+// Copy an overlay to a corner of the screen, returning the area it covers.
+func drawOverlay(screen screenBuffer, overlay *image.NRGBA, corner int) image.Rectangle {
+	rect := overlayRect(screen, overlay.Bounds().Dx(), overlay.Bounds().Dy(), corner)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		curPixelBit := screen.offset(rect.Min.X, y)
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			screen.format.pack(screen.pixels[curPixelBit:], overlay.NRGBAAt(x-rect.Min.X, y-rect.Min.Y))
+			curPixelBit += screen.format.bytes
+		}
+	}
+	return rect
+}
+
+// Frame drawn around images, given as width:rrggbb.
+type border struct {
+	width int
+	color color.NRGBA
+}
+
+func (frame *border) UnmarshalText(text []byte) error {
+	parts := strings.SplitN(string(text), ":", 2)
+	width, err := strconv.Atoi(parts[0])
+	if err != nil || width <= 0 || len(parts) != 2 {
+		return fmt.Errorf("invalid border: %s, expected width:rrggbb", text)
+	}
+	frame.width = width
+	frame.color, err = parseHexColor(parts[1])
+	return err
+}
+
+// Parse an rrggbb color, optionally starting with '#'.
+func parseHexColor(text string) (color.NRGBA, error) {
+	rgb, err := hex.DecodeString(strings.TrimPrefix(text, "#"))
+	if err != nil || len(rgb) != 3 {
+		return color.NRGBA{}, fmt.Errorf("invalid color: %s, expected rrggbb", text)
+	}
+	return color.NRGBA{rgb[0], rgb[1], rgb[2], 255}, nil
+}
+
+// Draw a frame around an area, returning the area covered by both.
+func drawBorder(screen screenBuffer, rect image.Rectangle, frame border) image.Rectangle {
+	screenRect := image.Rect(0, 0, screen.width, screen.height)
+	outer := rect.Inset(-frame.width).Intersect(screenRect)
+	sides := []image.Rectangle{
+		image.Rect(outer.Min.X, outer.Min.Y, outer.Max.X, rect.Min.Y),
+		image.Rect(outer.Min.X, rect.Max.Y, outer.Max.X, outer.Max.Y),
+		image.Rect(outer.Min.X, rect.Min.Y, rect.Min.X, rect.Max.Y),
+		image.Rect(rect.Max.X, rect.Min.Y, outer.Max.X, rect.Max.Y),
+	}
+	for _, side := range sides {
+		side = side.Intersect(screenRect)
+		for y := side.Min.Y; y < side.Max.Y; y++ {
+			curPixelBit := screen.offset(side.Min.X, y)
+			for x := side.Min.X; x < side.Max.X; x++ {
+				screen.format.pack(screen.pixels[curPixelBit:], frame.color)
+				curPixelBit += screen.format.bytes
+			}
+		}
+	}
+	return outer
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"sort"
+	"syscall"
+	"unsafe"
+)
+
+const FBIOGETCMAP = 0x4604
+const FBIOPUTCMAP = 0x4605
+
+type fb_cmap struct {
+	start  uint32
+	len    uint32
+	red    *uint16
+	green  *uint16
+	blue   *uint16
+	transp *uint16
+}
+
+// Colors of a screen whose pixels are indexes into a hardware palette, as
+// 8 bits per pixel pseudocolor modes are. Each image gets its own palette:
+// the first entries stay black and white for clearing and overlays, the
+// others are picked from the image by median cut.
+type palette struct {
+	colors [256]color.NRGBA
+	// Nearest entry plus one for each color reduced to 5 bits per channel,
+	// zero when not looked up yet
+	nearest []uint16
+	// Changed since last loaded into the hardware
+	pending bool
+}
+
+func newPalette() *palette {
+	pal := &palette{}
+	pal.update(nil)
+	return pal
+}
+
+// Pick the colors for an image, or reset to black and white for nil.
+func (pal *palette) update(img image.Image) {
+	pal.colors = [256]color.NRGBA{}
+	pal.colors[0] = color.NRGBA{0, 0, 0, 255}
+	pal.colors[1] = color.NRGBA{255, 255, 255, 255}
+	for i := 2; i < len(pal.colors); i++ {
+		pal.colors[i].A = 255
+	}
+	if img != nil {
+		copy(pal.colors[2:], medianCut(img, len(pal.colors)-2))
+	}
+	pal.nearest = make([]uint16, 1<<15)
+	pal.pending = true
+}
+
+func (pal *palette) index(pixel color.NRGBA) uint8 {
+	key := int(pixel.R>>3)<<10 | int(pixel.G>>3)<<5 | int(pixel.B>>3)
+	if pal.nearest[key] == 0 {
+		// Compare with the middle of the colors sharing the key
+		r, g, b := int(pixel.R|4), int(pixel.G|4), int(pixel.B|4)
+		best, bestDistance := 0, -1
+		for i, entry := range pal.colors {
+			dr, dg, db := r-int(entry.R), g-int(entry.G), b-int(entry.B)
+			distance := dr*dr + dg*dg + db*db
+			if bestDistance < 0 || distance < bestDistance {
+				best, bestDistance = i, distance
+			}
+		}
+		pal.nearest[key] = uint16(best + 1)
+	}
+	return uint8(pal.nearest[key] - 1)
+}
+
+// Up to count colors representing the image: its pixels get split in two
+// along their widest channel, at the median, until there are count boxes,
+// each standing for the average of its pixels.
+func medianCut(img image.Image, count int) []color.NRGBA {
+	bounds := img.Bounds()
+	// A sample is enough to pick colors from large images
+	step := 1
+	for bounds.Dx()*bounds.Dy()/(step*step) > 1<<16 {
+		step++
+	}
+	pixels := [][3]uint8{}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x < bounds.Max.X; x += step {
+			r, g, b, _ := color.NRGBAModel.Convert(img.At(x, y)).RGBA()
+			pixels = append(pixels, [3]uint8{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8)})
+		}
+	}
+	if len(pixels) == 0 {
+		return nil
+	}
+
+	widest := func(box [][3]uint8) (int, int) {
+		channel, spread := 0, 0
+		for c := 0; c < 3; c++ {
+			low, high := box[0][c], box[0][c]
+			for _, pixel := range box {
+				if pixel[c] < low {
+					low = pixel[c]
+				}
+				if pixel[c] > high {
+					high = pixel[c]
+				}
+			}
+			if int(high-low) > spread {
+				channel, spread = c, int(high-low)
+			}
+		}
+		return channel, spread
+	}
+	boxes := [][][3]uint8{pixels}
+	for len(boxes) < count {
+		split, splitChannel, splitSpread := -1, 0, 0
+		for i, box := range boxes {
+			if channel, spread := widest(box); spread > splitSpread {
+				split, splitChannel, splitSpread = i, channel, spread
+			}
+		}
+		if split < 0 {
+			// Every box holds a single color
+			break
+		}
+		box := boxes[split]
+		sort.Slice(box, func(i, j int) bool { return box[i][splitChannel] < box[j][splitChannel] })
+		median := len(box) / 2
+		boxes[split] = box[:median]
+		boxes = append(boxes, box[median:])
+	}
+
+	colors := make([]color.NRGBA, len(boxes))
+	for i, box := range boxes {
+		var sum [3]int
+		for _, pixel := range box {
+			for c := 0; c < 3; c++ {
+				sum[c] += int(pixel[c])
+			}
+		}
+		colors[i] = color.NRGBA{uint8(sum[0] / len(box)), uint8(sum[1] / len(box)), uint8(sum[2] / len(box)), 255}
+	}
+	return colors
+}
+
+func getColormap(fbF *os.File) ([]color.NRGBA, error) {
+	var red, green, blue [256]uint16
+	cmap := fb_cmap{len: 256, red: &red[0], green: &green[0], blue: &blue[0]}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fbF.Fd(), FBIOGETCMAP, uintptr(unsafe.Pointer(&cmap)))
+	if errno != 0 {
+		return nil, errno
+	}
+	colors := make([]color.NRGBA, 256)
+	for i := range colors {
+		colors[i] = color.NRGBA{uint8(red[i] >> 8), uint8(green[i] >> 8), uint8(blue[i] >> 8), 255}
+	}
+	return colors, nil
+}
+
+func putColormap(fbF *os.File, colors []color.NRGBA) error {
+	var red, green, blue [256]uint16
+	for i, entry := range colors {
+		red[i] = uint16(entry.R) * 0x101
+		green[i] = uint16(entry.G) * 0x101
+		blue[i] = uint16(entry.B) * 0x101
+	}
+	cmap := fb_cmap{len: uint32(len(colors)), red: &red[0], green: &green[0], blue: &blue[0]}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fbF.Fd(), FBIOPUTCMAP, uintptr(unsafe.Pointer(&cmap)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+// How a pixel's channels are packed into the framebuffer's bytes.
+// Offsets are bit positions in the little-endian value formed by a pixel's bytes.
+type pixelFormat struct {
+	bytes  int
+	red    fb_bitfield
+	green  fb_bitfield
+	blue   fb_bitfield
+	transp fb_bitfield
+	// Write fully opaque pixels whatever the source alpha
+	opaque bool
+	// Set for one byte pixels, which are indexes into it, see palette.go
+	palette *palette
+}
+
+// Named after the order of the channels in memory.
+var pixelFormats = map[string]pixelFormat{
+	"bgra":   {4, fb_bitfield{16, 8, 0}, fb_bitfield{8, 8, 0}, fb_bitfield{0, 8, 0}, fb_bitfield{24, 8, 0}, false, nil},
+	"rgba":   {4, fb_bitfield{0, 8, 0}, fb_bitfield{8, 8, 0}, fb_bitfield{16, 8, 0}, fb_bitfield{24, 8, 0}, false, nil},
+	"argb":   {4, fb_bitfield{8, 8, 0}, fb_bitfield{16, 8, 0}, fb_bitfield{24, 8, 0}, fb_bitfield{0, 8, 0}, false, nil},
+	"rgb565": {2, fb_bitfield{11, 5, 0}, fb_bitfield{5, 6, 0}, fb_bitfield{0, 5, 0}, fb_bitfield{0, 0, 0}, false, nil},
+	"rgb555": {2, fb_bitfield{10, 5, 0}, fb_bitfield{5, 5, 0}, fb_bitfield{0, 5, 0}, fb_bitfield{0, 0, 0}, false, nil},
+	"rgb666": {3, fb_bitfield{12, 6, 0}, fb_bitfield{6, 6, 0}, fb_bitfield{0, 6, 0}, fb_bitfield{0, 0, 0}, false, nil},
+	"bgr24":  {3, fb_bitfield{16, 8, 0}, fb_bitfield{8, 8, 0}, fb_bitfield{0, 8, 0}, fb_bitfield{0, 0, 0}, false, nil},
+	"rgb24":  {3, fb_bitfield{0, 8, 0}, fb_bitfield{8, 8, 0}, fb_bitfield{16, 8, 0}, fb_bitfield{0, 0, 0}, false, nil},
+	"rgb30":  {4, fb_bitfield{20, 10, 0}, fb_bitfield{10, 10, 0}, fb_bitfield{0, 10, 0}, fb_bitfield{30, 2, 0}, false, nil},
+	// Pseudocolor, the palette gets set up once the screen is open
+	"indexed": {bytes: 1},
+}
+
+// Supported depths, with the layout assumed when the driver leaves the bitfields empty.
+// Depths that are not a multiple of 8 still use whole bytes per pixel.
+var depthFormats = map[uint32]string{
+	8:  "indexed",
+	15: "rgb555",
+	16: "rgb565",
+	18: "rgb666",
+	24: "bgr24",
+	30: "rgb30",
+	32: "bgra",
+}
+
+// Bytes taken in memory by a pixel of the given depth.
+func depthBytes(bitsPerPixel uint32) int {
+	return int(bitsPerPixel+7) / 8
+}
+
+// Pixel format described by the driver. Some drivers leave the bitfields
+// empty, in which case we assume the usual layout for the depth.
+func detectPixelFormat(screeninfo fb_var_screeninfo) pixelFormat {
+	format := pixelFormat{
+		bytes:  depthBytes(screeninfo.bits_per_pixel),
+		red:    screeninfo.red,
+		green:  screeninfo.green,
+		blue:   screeninfo.blue,
+		transp: screeninfo.transp,
+	}
+	// Pseudocolor drivers describe the palette entries rather than the pixels
+	if screeninfo.bits_per_pixel == 8 ||
+		format.red.length == 0 && format.green.length == 0 && format.blue.length == 0 {
+		fallback := pixelFormats[depthFormats[screeninfo.bits_per_pixel]]
+		fallback.bytes = format.bytes
+		return fallback
+	}
+	return format
+}
+
+func packChannel(value uint8, field fb_bitfield) uint32 {
+	if field.length == 0 {
+		return 0
+	}
+	if field.length > 8 {
+		return uint32(value) * (1<<field.length - 1) / 255 << field.offset
+	}
+	return uint32(value) >> (8 - field.length) << field.offset
+}
+
+func unpackChannel(value uint32, field fb_bitfield) uint8 {
+	if field.length == 0 {
+		return 0
+	}
+	max := uint32(1)<<field.length - 1
+	return uint8((value >> field.offset & max) * 255 / max)
+}
+
+func (format pixelFormat) pack(dst []byte, pixColorBits color.NRGBA) {
+	if format.palette != nil {
+		dst[0] = format.palette.index(pixColorBits)
+		return
+	}
+	if format.opaque {
+		pixColorBits.A = 255
+	}
+	value := packChannel(pixColorBits.R, format.red) |
+		packChannel(pixColorBits.G, format.green) |
+		packChannel(pixColorBits.B, format.blue) |
+		packChannel(pixColorBits.A, format.transp)
+	for i := 0; i < format.bytes; i++ {
+		dst[i] = byte(value >> (8 * i))
+	}
+}
+
+// Pack a line of opaque pixels given as NRGBA bytes. Formats with a byte
+// per channel get their bytes written directly, without going through pack.
+func (format pixelFormat) packOpaque(dst []byte, src []uint8) {
+	byteChannel := func(field fb_bitfield) bool {
+		return field.length == 8 && field.offset%8 == 0 && int(field.offset/8) < format.bytes
+	}
+	if format.palette != nil || !byteChannel(format.red) || !byteChannel(format.green) || !byteChannel(format.blue) {
+		for i, j := 0, 0; j < len(src); i, j = i+format.bytes, j+4 {
+			format.pack(dst[i:], color.NRGBA{src[j], src[j+1], src[j+2], 255})
+		}
+		return
+	}
+	red, green, blue := format.red.offset/8, format.green.offset/8, format.blue.offset/8
+	transp := byteChannel(format.transp)
+	for i, j := 0, 0; j < len(src); i, j = i+format.bytes, j+4 {
+		pixel := dst[i : i+format.bytes]
+		pixel[red] = src[j]
+		pixel[green] = src[j+1]
+		pixel[blue] = src[j+2]
+		if transp {
+			pixel[format.transp.offset/8] = 255
+		}
+	}
+}
+
+func (format pixelFormat) unpack(src []byte) color.NRGBA {
+	if format.palette != nil {
+		return format.palette.colors[src[0]]
+	}
+	value := uint32(0)
+	for i := 0; i < format.bytes; i++ {
+		value |= uint32(src[i]) << (8 * i)
+	}
+	return color.NRGBA{
+		R: unpackChannel(value, format.red),
+		G: unpackChannel(value, format.green),
+		B: unpackChannel(value, format.blue),
+		A: 255,
+	}
+}
+
+// The visible part of the framebuffer memory.
+type screenBuffer struct {
+	pixels []byte
+	width  int
+	height int
+	stride int // pixels per line in memory
+	format pixelFormat
+	// Blend translucent pixels in linear light rather than sRGB, see --linearblend
+	linear bool
+}
+
+// Byte offset of a pixel.
+func (screen screenBuffer) offset(x int, y int) int {
+	return (y*screen.stride + x) * screen.format.bytes
+}
+
+// Part of the screen, drawn to as if it were the whole screen.
+func (screen screenBuffer) sub(rect image.Rectangle) screenBuffer {
+	sub := screen
+	sub.pixels = screen.pixels[screen.offset(rect.Min.X, rect.Min.Y):]
+	sub.width = rect.Dx()
+	sub.height = rect.Dy()
+	return sub
+}
+
+// Off-screen copy of the screen: drawing happens there, and only the regions
+// marked as changed get copied to the framebuffer.
+type backBuffer struct {
+	screenBuffer
+	front screenBuffer
+	dirty []image.Rectangle
+	// Compare with what the framebuffer holds and only write what differs
+	diff bool
+	// Mirror the output for panels mounted the wrong way, see --flipoutput
+	flipX bool
+	flipY bool
+	line  []byte
+	// Read back what was written, counting the bytes that differ and the
+	// area they lie in, see --verifywrite
+	verify       bool
+	mismatched   int
+	mismatchArea image.Rectangle
+}
+
+func newBackBuffer(front screenBuffer) *backBuffer {
+	back := backBuffer{screenBuffer: front, front: front}
+	back.pixels = make([]byte, len(front.pixels))
+	copy(back.pixels, front.pixels)
+	return &back
+}
+
+func (back *backBuffer) markDirty(rect image.Rectangle) {
+	rect = rect.Intersect(image.Rect(0, 0, back.width, back.height))
+	if !rect.Empty() {
+		back.dirty = append(back.dirty, rect)
+	}
+}
+
+func (back *backBuffer) flush() {
+	for _, rect := range back.dirty {
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			lineStart := back.offset(rect.Min.X, y)
+			line := back.pixels[lineStart : lineStart+rect.Dx()*back.format.bytes]
+			frontX, frontY := rect.Min.X, y
+			if back.flipX {
+				frontX = back.width - rect.Max.X
+				line = back.reverseLine(line)
+			}
+			if back.flipY {
+				frontY = back.height - 1 - y
+			}
+			frontStart := back.front.offset(frontX, frontY)
+			front := back.front.pixels[frontStart : frontStart+len(line)]
+			if back.diff {
+				copyChanged(front, line)
+			} else {
+				copy(front, line)
+			}
+			if back.verify {
+				back.checkLine(front, line, frontX, frontY)
+			}
+		}
+	}
+	back.dirty = back.dirty[:0]
+}
+
+// Compare a line of the framebuffer, starting at x, y, with what was written.
+func (back *backBuffer) checkLine(front []byte, line []byte, x int, y int) {
+	for i := range line {
+		if front[i] != line[i] {
+			back.mismatched++
+			pixelX := x + i/back.format.bytes
+			back.mismatchArea = back.mismatchArea.Union(image.Rect(pixelX, y, pixelX+1, y+1))
+		}
+	}
+}
+
+// Copy of a line with its pixels in reverse order, valid until the next call.
+func (back *backBuffer) reverseLine(line []byte) []byte {
+	if cap(back.line) < len(line) {
+		back.line = make([]byte, len(line))
+	}
+	reversed := back.line[:len(line)]
+	pixelBytes := back.format.bytes
+	for i := 0; i < len(line); i += pixelBytes {
+		copy(reversed[len(line)-i-pixelBytes:len(line)-i], line[i:i+pixelBytes])
+	}
+	return reversed
+}
+
+func copyChanged(front []byte, back []byte) {
+	start := 0
+	for start < len(back) {
+		if front[start] == back[start] {
+			start++
+			continue
+		}
+		spanEnd := start + 1
+		for spanEnd < len(back) && front[spanEnd] != back[spanEnd] {
+			spanEnd++
+		}
+		copy(front[start:spanEnd], back[start:spanEnd])
+		start = spanEnd
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"testing"
+)
+
+// A 4K photo-like JPEG, decoded and converted to NRGBA as transforms leave it.
+func decodedPhoto(b *testing.B) *image.NRGBA {
+	source := image.NewNRGBA(image.Rect(0, 0, 3840, 2160))
+	for y := 0; y < 2160; y++ {
+		for x := 0; x < 3840; x++ {
+			source.SetNRGBA(x, y, color.NRGBA{uint8(x), uint8(y), uint8(x * y >> 8), 255})
+		}
+	}
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, source, &jpeg.Options{Quality: 90}); err != nil {
+		b.Fatal(err)
+	}
+	decoded, err := jpeg.Decode(&encoded)
+	if err != nil {
+		b.Fatal(err)
+	}
+	photo := image.NewNRGBA(decoded.Bounds())
+	draw.Draw(photo, photo.Bounds(), decoded, decoded.Bounds().Min, draw.Src)
+	return photo
+}
+
+// Packing pixel by pixel, as for images with alpha, against packing whole
+// lines of an opaque image, as drawImage does for JPEGs.
+func BenchmarkPack(b *testing.B) {
+	photo := decodedPhoto(b)
+	width, height := photo.Bounds().Dx(), photo.Bounds().Dy()
+	for _, name := range []string{"bgra", "rgb565"} {
+		format := pixelFormats[name]
+		pixels := make([]byte, width*height*format.bytes)
+		b.Run(name+"/pack", func(b *testing.B) {
+			b.SetBytes(int64(width * height * 4))
+			for i := 0; i < b.N; i++ {
+				offset := 0
+				for y := 0; y < height; y++ {
+					for x := 0; x < width; x++ {
+						format.pack(pixels[offset:], photo.At(x, y).(color.NRGBA))
+						offset += format.bytes
+					}
+				}
+			}
+		})
+		b.Run(name+"/packOpaque", func(b *testing.B) {
+			b.SetBytes(int64(width * height * 4))
+			for i := 0; i < b.N; i++ {
+				for y := 0; y < height; y++ {
+					format.packOpaque(pixels[y*width*format.bytes:], photo.Pix[y*photo.Stride:y*photo.Stride+4*width])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Read a playlist where each line is: path[#weight] [duration] [transforms...]
+// Durations are in seconds or Go syntax such as 500ms; transforms default to the ones given on the command line.
+// Blank lines and lines starting with '#' are ignored.
+func readPlaylist(playlistPath string, defaultTransforms []string) ([]imgContext, error) {
+	playlistF, err := os.Open(playlistPath)
+	if err != nil {
+		return nil, err
+	}
+	defer playlistF.Close()
+
+	entries := []imgContext{}
+	scanner := bufio.NewScanner(playlistF)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		entry := newImgContext(fields[0], defaultTransforms)
+		fields = fields[1:]
+		if len(fields) > 0 {
+			if duration, err := parseInterval(fields[0]); err == nil {
+				if duration < 0 {
+					return nil, fmt.Errorf("%s:%d: negative duration", playlistPath, lineNumber)
+				}
+				entry.redraw = duration
+				fields = fields[1:]
+			}
+		}
+		if len(fields) > 0 {
+			entry.transforms = fields
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Images may be suffixed with a weight, as in sunset.jpg#3, showing them
+// that many times longer, and that many times more often when shuffling.
+func newImgContext(imgPath string, transforms []string) imgContext {
+	entry := imgContext{path: imgPath, transforms: transforms, weight: 1}
+	if hash := strings.LastIndex(imgPath, "#"); hash > 0 {
+		if weight, err := strconv.Atoi(imgPath[hash+1:]); err == nil && weight > 0 {
+			entry.path = imgPath[:hash]
+			entry.weight = weight
+		}
+	}
+	return entry
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// Proof of play: a JSON line per image shown, written once it goes away.
+type playLog struct {
+	file    *os.File
+	encoder *json.Encoder
+	path    string
+	since   time.Time
+}
+
+type playLogEntry struct {
+	Time     time.Time `json:"time"`
+	Path     string    `json:"path"`
+	Duration float64   `json:"duration"` // seconds
+}
+
+func openPlayLog(logPath string) (*playLog, error) {
+	logF, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &playLog{file: logF, encoder: json.NewEncoder(logF)}, nil
+}
+
+// Note an image being shown, recording the previous one if it changed.
+func (plays *playLog) show(imgPath string) error {
+	if imgPath == plays.path {
+		return nil
+	}
+	err := plays.record()
+	plays.path = imgPath
+	plays.since = time.Now()
+	return err
+}
+
+func (plays *playLog) record() error {
+	if plays.path == "" {
+		return nil
+	}
+	return plays.encoder.Encode(playLogEntry{
+		Time:     plays.since,
+		Path:     plays.path,
+		Duration: time.Since(plays.since).Seconds(),
+	})
+}
+
+// Record the image still shown and close the log.
+func (plays *playLog) close() error {
+	err := plays.record()
+	if closeErr := plays.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,194 @@
+//go:build png || !(jpeg || gif || bmp || webp || tiff || qoi || ico)
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"time"
+)
+
+// Animated PNG support, see https://wiki.mozilla.org/APNG_Specification
+
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+const (
+	apngDisposeBackground = 1
+	apngDisposePrevious   = 2
+	apngBlendOver         = 1
+)
+
+// Like browsers, show frames without a delay for 100ms.
+const apngDefaultDelay = 100 * time.Millisecond
+
+func init() {
+	registerDecoder("png", []string{".png"}, imageDecoder{decodePNG, png.DecodeConfig})
+}
+
+type pngChunk struct {
+	kind string
+	data []byte
+}
+
+// An animation frame: its fcTL control chunk and image data.
+type apngFrame struct {
+	control []byte
+	data    []byte
+}
+
+// Split a PNG file into chunks. Those read before a truncated one are
+// returned along with the error.
+func readPNGChunks(data []byte) ([]pngChunk, error) {
+	chunks := []pngChunk{}
+	for len(data) >= 12 {
+		size := binary.BigEndian.Uint32(data[0:4])
+		if uint64(size) > uint64(len(data)-12) {
+			return chunks, errors.New("png: truncated chunk")
+		}
+		chunk := pngChunk{kind: string(data[4:8]), data: data[8 : 8+size]}
+		chunks = append(chunks, chunk)
+		if chunk.kind == "IEND" {
+			break
+		}
+		data = data[12+size:]
+	}
+	return chunks, nil
+}
+
+func writePNGChunk(buf *bytes.Buffer, kind string, data []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	checksum := crc32.NewIEEE()
+	checksum.Write([]byte(kind))
+	checksum.Write(data)
+	buf.WriteString(kind)
+	buf.Write(data)
+	binary.Write(buf, binary.BigEndian, checksum.Sum32())
+}
+
+// Decode a PNG image. Animated files yield every frame, composited over
+// the canvas, along with how long each frame should be shown. Should the file
+// be damaged, the frames before are returned along with the error.
+func decodePNG(r io.Reader) ([]image.Image, []time.Duration, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	var chunks []pngChunk
+	var chunksErr error
+	if bytes.HasPrefix(data, []byte(pngSignature)) {
+		chunks, chunksErr = readPNGChunks(data[len(pngSignature):])
+	}
+
+	var header []byte
+	shared := []pngChunk{}
+	animated := false
+	frames := []*apngFrame{}
+	for _, chunk := range chunks {
+		switch chunk.kind {
+		case "IHDR":
+			header = chunk.data
+		case "PLTE", "tRNS":
+			shared = append(shared, chunk)
+		case "acTL":
+			animated = true
+		case "fcTL":
+			frames = append(frames, &apngFrame{control: chunk.data})
+		case "IDAT":
+			// Only part of the animation when a frame control comes first
+			if len(frames) > 0 {
+				frames[len(frames)-1].data = append(frames[len(frames)-1].data, chunk.data...)
+			}
+		case "fdAT":
+			if len(frames) > 0 && len(chunk.data) >= 4 {
+				frames[len(frames)-1].data = append(frames[len(frames)-1].data, chunk.data[4:]...)
+			}
+		}
+	}
+	if !animated || len(frames) == 0 || len(header) < 13 {
+		return singleFrame(png.Decode)(bytes.NewReader(data))
+	}
+
+	canvasWidth := int(binary.BigEndian.Uint32(header[0:4]))
+	canvasHeight := int(binary.BigEndian.Uint32(header[4:8]))
+	canvas := image.NewNRGBA(image.Rect(0, 0, canvasWidth, canvasHeight))
+	images := []image.Image{}
+	delays := []time.Duration{}
+	for _, frame := range frames {
+		if len(frame.control) < 26 {
+			return images, delays, errors.New("png: truncated frame control")
+		}
+		width := binary.BigEndian.Uint32(frame.control[4:8])
+		height := binary.BigEndian.Uint32(frame.control[8:12])
+		x := int(binary.BigEndian.Uint32(frame.control[12:16]))
+		y := int(binary.BigEndian.Uint32(frame.control[16:20]))
+		delayNum := binary.BigEndian.Uint16(frame.control[20:22])
+		delayDen := binary.BigEndian.Uint16(frame.control[22:24])
+		dispose := frame.control[24]
+		blend := frame.control[25]
+		if dispose == apngDisposePrevious && len(images) == 0 {
+			// Nothing before the first frame, as the specification says
+			dispose = apngDisposeBackground
+		}
+
+		img, err := decodeAPNGFrame(header, shared, frame.data, width, height)
+		if err != nil {
+			return images, delays, err
+		}
+
+		var previous []byte
+		if dispose == apngDisposePrevious {
+			previous = make([]byte, len(canvas.Pix))
+			copy(previous, canvas.Pix)
+		}
+		frameRect := image.Rect(x, y, x+int(width), y+int(height))
+		if blend == apngBlendOver {
+			draw.Draw(canvas, frameRect, img, img.Bounds().Min, draw.Over)
+		} else {
+			draw.Draw(canvas, frameRect, img, img.Bounds().Min, draw.Src)
+		}
+		snapshot := image.NewNRGBA(canvas.Bounds())
+		copy(snapshot.Pix, canvas.Pix)
+		images = append(images, snapshot)
+
+		if delayDen == 0 {
+			delayDen = 100
+		}
+		delay := time.Duration(delayNum) * time.Second / time.Duration(delayDen)
+		if delay == 0 {
+			delay = apngDefaultDelay
+		}
+		delays = append(delays, delay)
+
+		switch dispose {
+		case apngDisposeBackground:
+			draw.Draw(canvas, frameRect, image.Transparent, image.Point{}, draw.Src)
+		case apngDisposePrevious:
+			copy(canvas.Pix, previous)
+		}
+	}
+	return images, delays, chunksErr
+}
+
+// Wrap a frame's data into a standalone PNG file the decoder understands.
+func decodeAPNGFrame(header []byte, shared []pngChunk, data []byte, width uint32, height uint32) (image.Image, error) {
+	frameHeader := make([]byte, len(header))
+	copy(frameHeader, header)
+	binary.BigEndian.PutUint32(frameHeader[0:4], width)
+	binary.BigEndian.PutUint32(frameHeader[4:8], height)
+
+	file := bytes.Buffer{}
+	file.WriteString(pngSignature)
+	writePNGChunk(&file, "IHDR", frameHeader)
+	for _, chunk := range shared {
+		writePNGChunk(&file, chunk.kind, chunk.data)
+	}
+	writePNGChunk(&file, "IDAT", data)
+	writePNGChunk(&file, "IEND", nil)
+	return png.Decode(&file)
+}
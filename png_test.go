@@ -0,0 +1,64 @@
+//go:build png || !(jpeg || gif || bmp || webp || tiff || qoi || ico)
+
+package main
+
+import (
+	"bytes"
+	"image/color"
+	"os"
+	"testing"
+	"time"
+)
+
+// The fixture is a 4x4 animation of three frames: red over the whole canvas,
+// disposed of as "previous", then a blue square at the top left and a green
+// one at the bottom right, both kept.
+func TestDecodeAPNG(t *testing.T) {
+	data, err := os.ReadFile("testdata/animated.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	red, blue, green := color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 0, 255, 255}, color.NRGBA{0, 255, 0, 255}
+	clear := color.NRGBA{}
+
+	frames, delays, err := decodePNG(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 3 {
+		t.Fatalf("decoded %d frames, want 3", len(frames))
+	}
+	wantDelays := []time.Duration{100 * time.Millisecond, 100 * time.Millisecond, apngDefaultDelay}
+	for i, want := range wantDelays {
+		if delays[i] != want {
+			t.Errorf("frame %d lasts %v, want %v", i, delays[i], want)
+		}
+	}
+	tests := []struct {
+		frame int
+		x, y  int
+		want  color.NRGBA
+	}{
+		{0, 3, 3, red},
+		// Disposing of the first frame as "previous" clears it like "background"
+		{1, 0, 0, blue},
+		{1, 3, 3, clear},
+		{2, 0, 0, blue},
+		{2, 3, 3, green},
+		{2, 3, 0, clear},
+	}
+	for _, test := range tests {
+		if got := color.NRGBAModel.Convert(frames[test.frame].At(test.x, test.y)); got != test.want {
+			t.Errorf("frame %d has %v at %d,%d, want %v", test.frame, got, test.x, test.y, test.want)
+		}
+	}
+
+	// Cut within the last frame, the first two are still there
+	frames, _, err = decodePNG(bytes.NewReader(data[:len(data)-30]))
+	if err == nil {
+		t.Error("a truncated animation decoded without error")
+	}
+	if len(frames) != 2 {
+		t.Errorf("decoded %d frames before the damage, want 2", len(frames))
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"time"
+)
+
+// How long preloading goes on before the progress bar shows up, so that it
+// does not flash by when images load quickly.
+const progressDelay = 500 * time.Millisecond
+
+// Draw a bar in the middle of the screen, filled as far as images have been
+// loaded, with the count below it.
+func drawProgress(screen screenBuffer, loaded int, total int) {
+	white := color.NRGBA{255, 255, 255, 255}
+	barWidth, barHeight := screen.width/2, screen.height/40
+	if barHeight < 8 {
+		barHeight = 8
+	}
+	label := renderText(fmt.Sprintf("Loading %d/%d", loaded, total))
+	bar := image.Rect(0, 0, barWidth, barHeight).Add(image.Pt((screen.width-barWidth)/2, (screen.height-barHeight)/2))
+	text := label.Bounds().Add(image.Pt((screen.width-label.Bounds().Dx())/2, bar.Max.Y+overlayMargin))
+	screenRect := image.Rect(0, 0, screen.width, screen.height)
+	if !text.In(screenRect) || barWidth < 2 {
+		return
+	}
+	clearRect(screen, bar.Union(text).Inset(-overlayMargin).Intersect(screenRect))
+	drawBorder(screen, bar.Inset(1), border{width: 1, color: white})
+	filled := bar.Inset(2)
+	filled.Max.X = filled.Min.X + filled.Dx()*loaded/total
+	for y := filled.Min.Y; y < filled.Max.Y; y++ {
+		curPixelBit := screen.offset(filled.Min.X, y)
+		for x := filled.Min.X; x < filled.Max.X; x++ {
+			screen.format.pack(screen.pixels[curPixelBit:], white)
+			curPixelBit += screen.format.bytes
+		}
+	}
+	for y := text.Min.Y; y < text.Max.Y; y++ {
+		curPixelBit := screen.offset(text.Min.X, y)
+		for x := text.Min.X; x < text.Max.X; x++ {
+			screen.format.pack(screen.pixels[curPixelBit:], label.NRGBAAt(x-text.Min.X, y-text.Min.Y))
+			curPixelBit += screen.format.bytes
+		}
+	}
+}
@@ -0,0 +1,111 @@
+//go:build qoi || !(png || jpeg || gif || bmp || webp || tiff || ico)
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+)
+
+// Decoder for the Quite OK Image format, see https://qoiformat.org/qoi-specification.pdf
+
+const qoiMagic = "qoif"
+
+const (
+	qoiOpIndex = 0x00
+	qoiOpDiff  = 0x40
+	qoiOpLuma  = 0x80
+	qoiOpRun   = 0xc0
+	qoiOpRGB   = 0xfe
+	qoiOpRGBA  = 0xff
+	qoiMask    = 0xc0
+)
+
+func init() {
+	image.RegisterFormat("qoi", qoiMagic, decodeQOI, decodeQOIConfig)
+	registerDecoder("qoi", []string{".qoi"}, imageDecoder{singleFrame(decodeQOI), decodeQOIConfig})
+}
+
+func decodeQOIConfig(r io.Reader) (image.Config, error) {
+	header := make([]byte, 14)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return image.Config{}, err
+	}
+	if string(header[:4]) != qoiMagic {
+		return image.Config{}, errors.New("qoi: invalid format")
+	}
+	width := binary.BigEndian.Uint32(header[4:8])
+	height := binary.BigEndian.Uint32(header[8:12])
+	if width == 0 || height == 0 || width > 1<<15 || height > 1<<15 {
+		return image.Config{}, errors.New("qoi: unsupported dimensions")
+	}
+	return image.Config{ColorModel: color.NRGBAModel, Width: int(width), Height: int(height)}, nil
+}
+
+func decodeQOI(r io.Reader) (image.Image, error) {
+	reader := bufio.NewReader(r)
+	config, err := decodeQOIConfig(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, config.Width, config.Height))
+	var index [64]color.NRGBA
+	pixel := color.NRGBA{0, 0, 0, 255}
+	run := 0
+	for i := 0; i < len(img.Pix); i += 4 {
+		if run > 0 {
+			run--
+		} else {
+			op, err := reader.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case op == qoiOpRGB:
+				if pixel.R, err = reader.ReadByte(); err == nil {
+					if pixel.G, err = reader.ReadByte(); err == nil {
+						pixel.B, err = reader.ReadByte()
+					}
+				}
+			case op == qoiOpRGBA:
+				if pixel.R, err = reader.ReadByte(); err == nil {
+					if pixel.G, err = reader.ReadByte(); err == nil {
+						if pixel.B, err = reader.ReadByte(); err == nil {
+							pixel.A, err = reader.ReadByte()
+						}
+					}
+				}
+			case op&qoiMask == qoiOpIndex:
+				pixel = index[op]
+			case op&qoiMask == qoiOpDiff:
+				pixel.R += (op>>4)&0x03 - 2
+				pixel.G += (op>>2)&0x03 - 2
+				pixel.B += op&0x03 - 2
+			case op&qoiMask == qoiOpLuma:
+				var next byte
+				next, err = reader.ReadByte()
+				greenDiff := op&0x3f - 32
+				pixel.R += greenDiff + (next>>4)&0x0f - 8
+				pixel.G += greenDiff
+				pixel.B += greenDiff + next&0x0f - 8
+			case op&qoiMask == qoiOpRun:
+				run = int(op & 0x3f)
+			}
+			if err != nil {
+				return nil, err
+			}
+			index[(int(pixel.R)*3+int(pixel.G)*5+int(pixel.B)*7+int(pixel.A)*11)%64] = pixel
+		}
+
+		img.Pix[i] = pixel.R
+		img.Pix[i+1] = pixel.G
+		img.Pix[i+2] = pixel.B
+		img.Pix[i+3] = pixel.A
+	}
+	return img, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Save images as PNG instead of showing them, on a screen sized by
+// --geometry as for --dryrun. Several images are saved as numbered files:
+// out-1.png, out-2.png...
+func renderToFile(sources []imgContext, args args) error {
+	if len(sources) > 1 && args.RenderTo == "-" {
+		return fmt.Errorf("%w: several images cannot all be rendered to stdout", errUsage)
+	}
+	screen_width, screen_height := dryRunWidth, dryRunHeight
+	if args.Geometry != nil {
+		screen_width, screen_height = args.Geometry.width, args.Geometry.height
+	}
+	return renderOffscreen(sources, args, screen_width, screen_height, func(imageContext imgContext, index int, count int, rendered image.Image) error {
+		path := args.RenderTo
+		if count > 1 {
+			extension := filepath.Ext(path)
+			path = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(path, extension), index+1, extension)
+		}
+		if err := writePNG(path, rendered); err != nil {
+			return err
+		}
+		if args.Verbose {
+			fmt.Fprintln(os.Stderr, imageContext.path, "rendered to", path)
+		}
+		return nil
+	})
+}
+
+// Run the images through the whole pipeline, as --compose draws them, onto
+// a screen held in memory, handing each result over instead of showing it.
+func renderOffscreen(sources []imgContext, args args, full_width int, full_height int,
+	output func(imageContext imgContext, index int, count int, rendered image.Image) error) error {
+	if len(sources) == 0 {
+		return fmt.Errorf("%w: no image to render", errUsage)
+	}
+	format := pixelFormats["bgra"]
+	format.opaque = true
+	canvas := screenBuffer{
+		pixels: make([]byte, full_width*full_height*format.bytes),
+		width:  full_width,
+		height: full_height,
+		stride: full_width,
+		format: format,
+		linear: args.LinearBlend,
+	}
+	screen := canvas
+	if args.Viewport != nil {
+		rect := image.Rectangle(*args.Viewport)
+		if !rect.In(image.Rect(0, 0, full_width, full_height)) {
+			return fmt.Errorf("%w: viewport %v exceeds the %dx%d screen", errUsage, rect, full_width, full_height)
+		}
+		screen = canvas.sub(rect)
+	}
+
+	if args.BgImage.path != "" {
+		if err := args.BgImage.load(args, screen.width, screen.height); err != nil {
+			return fmt.Errorf("%w: background %v", errInput, err)
+		}
+	}
+	var imageContexts []imgContext
+	var err error
+	if args.Montage != nil {
+		imageContexts, err = loadMontage(sources, args, screen.width, screen.height, nil)
+	} else {
+		imageContexts, err = loadImages(sources, args, screen.width, screen.height, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInput, err)
+	}
+	if args.Watermark.path != "" {
+		if err := args.Watermark.load(args, screen.width, screen.height); err != nil {
+			return fmt.Errorf("%w: watermark %v", errInput, err)
+		}
+	}
+	for i, imageContext := range imageContexts {
+		composeImage(screen, imageContext)
+		if args.Border != nil {
+			drawBorder(screen, imageContext.screenRect(), *args.Border)
+		}
+		if args.Watermark.path != "" {
+			drawWatermark(screen, &args.Watermark)
+		}
+		if err := output(imageContext, i, len(imageContexts), captureScreen(canvas)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
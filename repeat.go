@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"time"
+
+	"github.com/eiannone/keyboard"
+)
+
+// Alternate the images as fast as --repeat asks, within --fps, for burn-in
+// and stress tests of the panel. Images are rendered once beforehand so that
+// each frame is only a copy to the screen. Stops after --duration, or on Esc,
+// then reports the frame rate achieved.
+func repeatImages(back *backBuffer, imageContexts []imgContext, args args, flush func() error, keysEvents <-chan keyboard.KeyEvent) error {
+	full := image.Rect(0, 0, back.width, back.height)
+	if back.format.palette != nil {
+		// A palette per image cannot follow frames this fast
+		back.format.palette.update(imageContexts[0].image)
+	}
+	rendered := make([][]byte, len(imageContexts))
+	for i, imageContext := range imageContexts {
+		clearRect(back.screenBuffer, full)
+		if imageContext.background != nil {
+			drawImage(back.screenBuffer, imgContext{
+				image:        imageContext.background,
+				image_width:  back.width,
+				image_height: back.height,
+			})
+		}
+		if args.Compose {
+			composeImage(back.screenBuffer, imageContext)
+		} else {
+			drawImage(back.screenBuffer, imageContext)
+		}
+		rendered[i] = make([]byte, len(back.pixels))
+		copy(rendered[i], back.pixels)
+	}
+
+	frameInterval := time.Second / time.Duration(args.Repeat*len(imageContexts))
+	if args.Fps > 0 && frameInterval < time.Second/time.Duration(args.Fps) {
+		frameInterval = time.Second / time.Duration(args.Fps)
+	}
+	start := time.Now()
+	frames := 0
+repeating:
+	for args.Duration == 0 || time.Since(start) < time.Duration(args.Duration) {
+		select {
+		case event := <-keysEvents:
+			if event.Key == keyboard.KeyEsc {
+				break repeating
+			}
+		default:
+		}
+		frameStart := time.Now()
+		copy(back.pixels, rendered[frames%len(rendered)])
+		back.markDirty(full)
+		if err := flush(); err != nil {
+			return err
+		}
+		frames++
+		time.Sleep(frameInterval - time.Since(frameStart))
+	}
+	elapsed := time.Since(start)
+	fmt.Printf("%d frames in %v: %.1f frames per second, %.1f asked for\n",
+		frames, elapsed.Round(time.Millisecond), float64(frames)/elapsed.Seconds(), float64(time.Second)/float64(frameInterval))
+	return nil
+}
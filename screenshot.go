@@ -0,0 +1,37 @@
+package main
+
+import (
+	"image"
+	"image/png"
+	"os"
+)
+
+// Read back the framebuffer content. Alpha is forced to opaque as most
+// framebuffers leave that byte unused.
+func captureScreen(screen screenBuffer) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, screen.width, screen.height))
+	for y := 0; y < screen.height; y++ {
+		curPixelBit := screen.offset(0, y)
+		for x := 0; x < screen.width; x++ {
+			img.SetNRGBA(x, y, screen.format.unpack(screen.pixels[curPixelBit:]))
+			curPixelBit += screen.format.bytes
+		}
+	}
+	return img
+}
+
+// Encode an image as PNG to a file, or to stdout when the path is "-".
+func writePNG(path string, img image.Image) error {
+	if path == "-" {
+		return png.Encode(os.Stdout, img)
+	}
+	outF, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(outF, img)
+	if closeErr := outF.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Frame rate of --sequence when --fps does not give one.
+const sequenceFps = 25
+
+// Numbered images played as the frames of an animation, given as a printf
+// style template and a range, as in frame_%04d.png:1-120.
+type sequence struct {
+	template string
+	first    int
+	last     int
+}
+
+func (seq *sequence) UnmarshalText(text []byte) error {
+	colon := strings.LastIndex(string(text), ":")
+	if colon < 0 {
+		return fmt.Errorf("invalid sequence: %s, expected template:first-last", text)
+	}
+	seq.template = string(text[:colon])
+	var extra string
+	n, _ := fmt.Sscanf(string(text[colon+1:]), "%d-%d%s", &seq.first, &seq.last, &extra)
+	if n != 2 || seq.first < 0 || seq.last < seq.first {
+		return fmt.Errorf("invalid sequence range: %s, expected first-last", text[colon+1:])
+	}
+	if !strings.Contains(seq.template, "%") {
+		return fmt.Errorf("invalid sequence template: %s, expected a number placeholder such as %%04d", seq.template)
+	}
+	return nil
+}
+
+// The sequence as a single image whose frames are read from each path.
+func (seq *sequence) context(transforms []string) imgContext {
+	entry := imgContext{path: seq.template, transforms: transforms, weight: 1}
+	for number := seq.first; number <= seq.last; number++ {
+		entry.sequence = append(entry.sequence, fmt.Sprintf(seq.template, number))
+	}
+	return entry
+}
+
+// Decode every image of a sequence, keeping the first frame of each.
+func decodeSequence(imageContext imgContext, args args) (imgContext, error) {
+	delay := time.Second / sequenceFps
+	if args.Fps > 0 {
+		delay = time.Second / time.Duration(args.Fps)
+	}
+	frameArgs := args
+	frameArgs.Verbose = false
+	imageContext.decoded = nil
+	imageContext.delays = nil
+	imageContext.opaque = true
+	for _, path := range imageContext.sequence {
+		frame, err := decodeImage(imgContext{path: path, weight: 1}, frameArgs)
+		if err != nil {
+			return imageContext, err
+		}
+		imageContext.decoded = append(imageContext.decoded, frame.decoded[0])
+		imageContext.opaque = imageContext.opaque && frame.opaque
+		imageContext.delays = append(imageContext.delays, delay)
+		imageContext.format = frame.format
+	}
+	if args.Verbose {
+		fmt.Fprintln(os.Stderr, "Sequence frames:", len(imageContext.decoded))
+	}
+	return imageContext, nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/disintegration/imaging"
+)
+
+// Darkness of the shadow where it is not blurred.
+const shadowOpacity = 160
+
+// The background with a soft shadow cast below and to the right of the area
+// an image covers, size pixels away from it and blurred over as many.
+func dropShadow(background image.Image, rect image.Rectangle, size int, screen_width int, screen_height int) image.Image {
+	canvas := image.NewNRGBA(image.Rect(0, 0, screen_width, screen_height))
+	draw.Draw(canvas, canvas.Bounds(), background, image.Point{}, draw.Src)
+	// Room for the blur to spread around the shape
+	mask := image.NewNRGBA(image.Rect(0, 0, rect.Dx()+4*size, rect.Dy()+4*size))
+	draw.Draw(mask, mask.Bounds().Inset(2*size), image.NewUniform(color.NRGBA{0, 0, 0, shadowOpacity}), image.Point{}, draw.Src)
+	blurred := imaging.Blur(mask, float64(size)/2)
+	origin := rect.Min.Sub(image.Pt(size, size))
+	draw.Draw(canvas, blurred.Bounds().Add(origin), blurred, image.Point{}, draw.Over)
+	return canvas
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+var fallbacks = map[string]bool{
+	"":      true,
+	"sixel": true,
+}
+
+// Character cell size assumed for terminals not reporting their size in pixels.
+const sixelCellWidth = 10
+const sixelCellHeight = 20
+
+// Show the images in the terminal with sixel graphics, one after the other,
+// for a preview where there is no framebuffer, over SSH for instance.
+func showSixel(sources []imgContext, args args) error {
+	screen_width, screen_height := sixelTerminalSize()
+	if args.Geometry != nil {
+		screen_width, screen_height = args.Geometry.width, args.Geometry.height
+	}
+	if args.Verbose {
+		fmt.Fprintf(os.Stderr, "Showing images in the terminal at %dx%d\n", screen_width, screen_height)
+	}
+	out := bufio.NewWriter(os.Stdout)
+	return renderOffscreen(sources, args, screen_width, screen_height, func(imageContext imgContext, index int, count int, rendered image.Image) error {
+		writeSixel(out, rendered)
+		return out.Flush()
+	})
+}
+
+// Size of the terminal in pixels, keeping a line for the prompt.
+func sixelTerminalSize() (int, int) {
+	size, err := unix.IoctlGetWinsize(int(os.Stdout.Fd()), unix.TIOCGWINSZ)
+	if err != nil || size.Col == 0 || size.Row < 2 {
+		return 80 * sixelCellWidth, 23 * sixelCellHeight
+	}
+	if size.Xpixel == 0 || size.Ypixel == 0 {
+		return int(size.Col) * sixelCellWidth, int(size.Row-1) * sixelCellHeight
+	}
+	return int(size.Xpixel), int(size.Ypixel) * int(size.Row-1) / int(size.Row)
+}
+
+// Encode an opaque image as sixels, using a 6x6x6 color cube for palette:
+// each band of 6 rows is written once per color it uses, as runs of
+// characters whose bits tell which of the rows have that color.
+func writeSixel(out io.Writer, img image.Image) {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	fmt.Fprintf(out, "\033Pq\"1;1;%d;%d", width, bounds.Dy())
+	for i := 0; i < 216; i++ {
+		fmt.Fprintf(out, "#%d;2;%d;%d;%d", i, i/36*20, i/6%6*20, i%6*20)
+	}
+
+	bands := make([][]byte, 216)
+	for top := bounds.Min.Y; top < bounds.Max.Y; top += 6 {
+		used := []int{}
+		for y := top; y < top+6 && y < bounds.Max.Y; y++ {
+			for x := 0; x < width; x++ {
+				r, g, b, _ := img.At(bounds.Min.X+x, y).RGBA()
+				index := int((r*5+0x7fff)/0xffff*36 + (g*5+0x7fff)/0xffff*6 + (b*5+0x7fff)/0xffff)
+				if bands[index] == nil {
+					bands[index] = make([]byte, width)
+					used = append(used, index)
+				}
+				bands[index][x] |= 1 << (y - top)
+			}
+		}
+		for n, index := range used {
+			if n > 0 {
+				// Back to the start of the band for the next color
+				fmt.Fprint(out, "$")
+			}
+			fmt.Fprintf(out, "#%d", index)
+			writeSixelRuns(out, bands[index])
+			bands[index] = nil
+		}
+		fmt.Fprint(out, "-")
+	}
+	fmt.Fprint(out, "\033\\")
+}
+
+func writeSixelRuns(out io.Writer, bits []byte) {
+	for x := 0; x < len(bits); {
+		run := 1
+		for x+run < len(bits) && bits[x+run] == bits[x] {
+			run++
+		}
+		if run > 3 {
+			fmt.Fprintf(out, "!%d%c", run, 63+bits[x])
+		} else {
+			for i := 0; i < run; i++ {
+				fmt.Fprintf(out, "%c", 63+bits[x])
+			}
+		}
+		x += run
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+const testPatternGrid = 64
+const testPatternMarker = 32
+
+var testPatternBars = []color.NRGBA{
+	{255, 255, 255, 255},
+	{255, 255, 0, 255},
+	{0, 255, 255, 255},
+	{0, 255, 0, 255},
+	{255, 0, 255, 255},
+	{255, 0, 0, 255},
+	{0, 0, 255, 255},
+	{0, 0, 0, 255},
+}
+
+// Calibration image: color bars on top, then red, green, blue and gray
+// gradients, a grid whose lines would slant if the stride were wrong, and
+// corner markers (red, green, blue, white clockwise from the top left).
+func testPattern(width int, height int) *image.NRGBA {
+	pattern := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(pattern, pattern.Bounds(), image.Black, image.Point{}, draw.Src)
+
+	for x := 0; x < width; x++ {
+		bar := testPatternBars[x*len(testPatternBars)/width]
+		for y := 0; y < height/3; y++ {
+			pattern.SetNRGBA(x, y, bar)
+		}
+	}
+
+	gradientHeight := height / 3 / 4
+	for x := 0; x < width; x++ {
+		level := uint8(x * 255 / width)
+		gradients := []color.NRGBA{{level, 0, 0, 255}, {0, level, 0, 255}, {0, 0, level, 255}, {level, level, level, 255}}
+		for i, gradient := range gradients {
+			for y := height/3 + i*gradientHeight; y < height/3+(i+1)*gradientHeight; y++ {
+				pattern.SetNRGBA(x, y, gradient)
+			}
+		}
+	}
+
+	gray := color.NRGBA{128, 128, 128, 255}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if x%testPatternGrid == 0 || y%testPatternGrid == 0 || x == width-1 || y == height-1 {
+				pattern.SetNRGBA(x, y, gray)
+			}
+		}
+	}
+
+	corners := []struct {
+		point image.Point
+		color color.NRGBA
+	}{
+		{image.Pt(0, 0), color.NRGBA{255, 0, 0, 255}},
+		{image.Pt(width-testPatternMarker, 0), color.NRGBA{0, 255, 0, 255}},
+		{image.Pt(width-testPatternMarker, height-testPatternMarker), color.NRGBA{0, 0, 255, 255}},
+		{image.Pt(0, height-testPatternMarker), color.NRGBA{255, 255, 255, 255}},
+	}
+	for _, corner := range corners {
+		marker := image.Rectangle{corner.point, corner.point.Add(image.Pt(testPatternMarker, testPatternMarker))}
+		draw.Draw(pattern, marker, &image.Uniform{corner.color}, image.Point{}, draw.Src)
+	}
+	return pattern
+}
@@ -0,0 +1,11 @@
+//go:build tiff || !(png || jpeg || gif || bmp || webp || qoi || ico)
+
+package main
+
+import (
+	"golang.org/x/image/tiff"
+)
+
+func init() {
+	registerDecoder("tiff", []string{".tif", ".tiff"}, imageDecoder{singleFrame(tiff.Decode), tiff.DecodeConfig})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+func defaultTrashDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "modernfbv-trash")
+	}
+	return filepath.Join(home, ".local", "share", "Trash", "files")
+}
+
+// Move an image file to the trash directory, without overwriting anything there.
+// Images not read from a file of their own cannot be moved.
+func trashImage(imageContext imgContext, trashDir string) (string, error) {
+	imgPath := imageContext.path
+	if imageContext.archive != "" {
+		return "", fmt.Errorf("%s is part of an archive and cannot be deleted", imgPath)
+	}
+	if imageContext.data != nil {
+		return "", fmt.Errorf("%s was given inline and has no file to delete", imgPath)
+	}
+	if len(imageContext.sequence) > 0 {
+		return "", fmt.Errorf("%s is a sequence of files and cannot be deleted", imgPath)
+	}
+	info, err := os.Stat(imgPath)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file, not moving it", imgPath)
+	}
+
+	if err := os.MkdirAll(trashDir, 0700); err != nil {
+		return "", err
+	}
+	// Renaming replaces its target, so the name is first taken with an empty file
+	trashPath := filepath.Join(trashDir, filepath.Base(imgPath))
+	for count := 1; ; count++ {
+		trashF, err := os.OpenFile(trashPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			trashF.Close()
+			break
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", err
+		}
+		trashPath = fmt.Sprintf("%s.%d", filepath.Join(trashDir, filepath.Base(imgPath)), count)
+	}
+
+	err = os.Rename(imgPath, trashPath)
+	if errors.Is(err, syscall.EXDEV) {
+		err = copyFile(imgPath, trashPath)
+		if err == nil {
+			err = os.Remove(imgPath)
+		}
+	}
+	if err != nil {
+		os.Remove(trashPath)
+		return "", err
+	}
+	return trashPath, nil
+}
+
+func copyFile(srcPath string, dstPath string) error {
+	srcF, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer srcF.Close()
+
+	dstF, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dstF, srcF); err != nil {
+		dstF.Close()
+		return err
+	}
+	return dstF.Close()
+}
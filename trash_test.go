@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Images of the same name deleted in a row all stay in the trash.
+func TestTrashImageSameName(t *testing.T) {
+	trashDir := t.TempDir()
+	var trashed []string
+	for _, content := range []string{"first", "second", "third"} {
+		imgPath := filepath.Join(t.TempDir(), "photo.jpg")
+		if err := os.WriteFile(imgPath, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		trashPath, err := trashImage(imgContext{path: imgPath}, trashDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(imgPath); !os.IsNotExist(err) {
+			t.Errorf("%s is still there after being moved to %s", imgPath, trashPath)
+		}
+		trashed = append(trashed, trashPath)
+	}
+	for i, content := range []string{"first", "second", "third"} {
+		data, err := os.ReadFile(trashed[i])
+		if err != nil || string(data) != content {
+			t.Errorf("%s holds %q, want %q", trashed[i], data, content)
+		}
+	}
+}
+
+func TestTrashImageWithoutFile(t *testing.T) {
+	trashDir := t.TempDir()
+	for _, imageContext := range []imgContext{
+		{path: "data:image/png", data: []byte{}},
+		{path: "photo.jpg", archive: "deck.zip", entry: "photo.jpg"},
+		{path: "frame%04d.png", sequence: []string{"frame0001.png", "frame0002.png"}},
+	} {
+		if _, err := trashImage(imageContext, trashDir); err == nil {
+			t.Errorf("%s moved to the trash", imageContext.path)
+		}
+	}
+}
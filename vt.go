@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+type vt_mode struct {
+	mode   int8
+	waitv  int8
+	relsig int16
+	acqsig int16
+	frsig  int16
+}
+
+const VT_GETMODE = 0x5601
+const VT_SETMODE = 0x5602
+const VT_RELDISP = 0x5605
+
+const VT_AUTO = 0
+const VT_PROCESS = 1
+const VT_ACKACQ = 2
+
+// While in process mode, the kernel asks us (SIGUSR1) before switching
+// away from our virtual terminal and tells us (SIGUSR2) when we are back.
+type vtSwitcher struct {
+	tty      *os.File
+	original vt_mode
+	signals  chan os.Signal
+}
+
+func watchVTSwitch() (*vtSwitcher, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	switcher := vtSwitcher{tty: tty, signals: make(chan os.Signal, 1)}
+	_, _, err = syscall.Syscall(syscall.SYS_IOCTL, tty.Fd(), VT_GETMODE, uintptr(unsafe.Pointer(&switcher.original)))
+	if int(err.(syscall.Errno)) != 0 {
+		tty.Close()
+		return nil, err
+	}
+
+	signal.Notify(switcher.signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	mode := vt_mode{
+		mode:   VT_PROCESS,
+		relsig: int16(syscall.SIGUSR1),
+		acqsig: int16(syscall.SIGUSR2),
+	}
+	_, _, err = syscall.Syscall(syscall.SYS_IOCTL, tty.Fd(), VT_SETMODE, uintptr(unsafe.Pointer(&mode)))
+	if int(err.(syscall.Errno)) != 0 {
+		signal.Stop(switcher.signals)
+		tty.Close()
+		return nil, err
+	}
+
+	return &switcher, nil
+}
+
+// Let the kernel proceed with a switch; returns whether we are now in the foreground.
+func (switcher *vtSwitcher) acknowledge(sig os.Signal) bool {
+	if sig == syscall.SIGUSR1 {
+		syscall.Syscall(syscall.SYS_IOCTL, switcher.tty.Fd(), VT_RELDISP, 1)
+		return false
+	}
+	syscall.Syscall(syscall.SYS_IOCTL, switcher.tty.Fd(), VT_RELDISP, VT_ACKACQ)
+	return true
+}
+
+func (switcher *vtSwitcher) close() {
+	mode := switcher.original
+	if mode.mode == VT_PROCESS {
+		mode.mode = VT_AUTO
+	}
+	syscall.Syscall(syscall.SYS_IOCTL, switcher.tty.Fd(), VT_SETMODE, uintptr(unsafe.Pointer(&mode)))
+	signal.Stop(switcher.signals)
+	switcher.tty.Close()
+}
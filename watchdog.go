@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"time"
+)
+
+// Removable displays, USB ones for instance, may go away and come back while
+// we run: writing to the mapping of a vanished device faults, and the device
+// file may be replaced by a new one. Either way the device gets opened again.
+
+// How often to check the device is still the one we opened.
+const watchdogInterval = time.Second
+
+// Run a function writing to the framebuffer, turning memory faults into errors.
+func writeGuarded(write func()) (err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if fault := recover(); fault != nil {
+			// Faults are the only panics we expect
+			if _, ok := fault.(interface{ Addr() uintptr }); !ok {
+				panic(fault)
+			}
+			err = fmt.Errorf("%v", fault)
+		}
+	}()
+	write()
+	return nil
+}
+
+// Whether the device file is still the one we opened and, unless its answers
+// are ignored, still responds to queries.
+func deviceValid(fbF *os.File, devicePath string, query bool) bool {
+	if query {
+		current := fb_var_screeninfo{}
+		if getScreenInfo(fbF, &current) != nil {
+			return false
+		}
+	}
+	openedInfo, err := fbF.Stat()
+	if err != nil {
+		return false
+	}
+	pathInfo, err := os.Stat(devicePath)
+	return err == nil && os.SameFile(openedInfo, pathInfo)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Watermarks are shrunk to at most this fraction of the screen, per side.
+const watermarkScreenFraction = 5
+
+var watermarkCorners = map[string]int{
+	"top-left":     overlayTopLeft,
+	"top-right":    overlayTopRight,
+	"bottom-left":  overlayBottomLeft,
+	"bottom-right": overlayBottomRight,
+}
+
+// Logo blended in a corner of every image, given as path[:corner[:opacity]].
+type watermark struct {
+	path    string
+	corner  int
+	opacity float64
+	image   *image.NRGBA
+}
+
+func (mark *watermark) UnmarshalText(text []byte) error {
+	parts := strings.Split(string(text), ":")
+	mark.corner = overlayBottomRight
+	mark.opacity = 1
+	if len(parts) >= 3 {
+		opacity, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+		if err == nil {
+			if opacity < 0 || opacity > 1 {
+				return fmt.Errorf("invalid watermark opacity: %s, expected 0 to 1", parts[len(parts)-1])
+			}
+			mark.opacity = opacity
+			parts = parts[:len(parts)-1]
+		}
+	}
+	if len(parts) >= 2 {
+		if corner, ok := watermarkCorners[parts[len(parts)-1]]; ok {
+			mark.corner = corner
+			parts = parts[:len(parts)-1]
+		}
+	}
+	// Whatever remains is the path, which may hold colons of its own
+	mark.path = strings.Join(parts, ":")
+	if mark.path == "" {
+		return fmt.Errorf("invalid watermark: %s, expected path:corner:opacity", text)
+	}
+	return nil
+}
+
+// Decode the watermark, shrink it to fit its share of the screen and apply
+// its opacity, so that drawing it is only a matter of blending.
+func (mark *watermark) load(args args, screen_width int, screen_height int) error {
+	markArgs := args
+	markArgs.Fill = "none"
+	markArgs.AutoOrient = false
+	markArgs.IntegerScale = false
+	markArgs.Verbose = false
+	markContext, err := loadImage(imgContext{path: mark.path, transforms: []string{}, weight: 1}, markArgs, screen_width, screen_height)
+	if err != nil {
+		return err
+	}
+	img := markContext.decoded[0]
+	maxWidth, maxHeight := screen_width/watermarkScreenFraction, screen_height/watermarkScreenFraction
+	if img.Bounds().Dx() > maxWidth || img.Bounds().Dy() > maxHeight {
+		img = imaging.Fit(img, maxWidth, maxHeight, imaging.Lanczos)
+	}
+
+	mark.image = image.NewNRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(mark.image, mark.image.Bounds(), img, img.Bounds().Min, draw.Src)
+	for i := 3; i < len(mark.image.Pix); i += 4 {
+		mark.image.Pix[i] = uint8(float64(mark.image.Pix[i])*mark.opacity + 0.5)
+	}
+	return nil
+}
+
+// Blend the watermark over what the screen shows, returning the area it covers.
+func drawWatermark(screen screenBuffer, mark *watermark) image.Rectangle {
+	rect := overlayRect(screen, mark.image.Bounds().Dx(), mark.image.Bounds().Dy(), mark.corner)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		curPixelBit := screen.offset(rect.Min.X, y)
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			pixColorBits := mark.image.NRGBAAt(x-rect.Min.X, y-rect.Min.Y)
+			if pixColorBits.A > 0 {
+				under := screen.format.unpack(screen.pixels[curPixelBit:])
+				screen.format.pack(screen.pixels[curPixelBit:], screen.blend(pixColorBits, under))
+			}
+			curPixelBit += screen.format.bytes
+		}
+	}
+	return rect
+}
@@ -0,0 +1,170 @@
+//go:build webp || !(png || jpeg || gif || bmp || tiff || qoi || ico)
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+	"time"
+
+	"golang.org/x/image/webp"
+)
+
+const webpAnimationFlag = 0x02
+const webpAlphaFlag = 0x10
+
+// Browsers show frames without a duration for 100ms, so do we.
+const webpDefaultDelay = 100 * time.Millisecond
+
+func init() {
+	registerDecoder("webp", []string{".webp"}, imageDecoder{decodeWebP, webp.DecodeConfig})
+}
+
+type webpChunk struct {
+	fourcc string
+	data   []byte
+}
+
+func readWebPChunks(data []byte) ([]webpChunk, error) {
+	chunks := []webpChunk{}
+	for len(data) >= 8 {
+		size := int(binary.LittleEndian.Uint32(data[4:8]))
+		if size > len(data)-8 {
+			return nil, errors.New("webp: truncated chunk")
+		}
+		chunks = append(chunks, webpChunk{fourcc: string(data[:4]), data: data[8 : 8+size]})
+		// Chunks are padded to an even size
+		size += size & 1
+		if size > len(data)-8 {
+			break
+		}
+		data = data[8+size:]
+	}
+	return chunks, nil
+}
+
+func writeWebPChunk(buf *bytes.Buffer, fourcc string, data []byte) {
+	buf.WriteString(fourcc)
+	binary.Write(buf, binary.LittleEndian, uint32(len(data)))
+	buf.Write(data)
+	if len(data)&1 == 1 {
+		buf.WriteByte(0)
+	}
+}
+
+func readUint24(data []byte) int {
+	return int(data[0]) | int(data[1])<<8 | int(data[2])<<16
+}
+
+// Decode a WebP image. Animated files yield every frame, composited over
+// the canvas, along with how long each frame should be shown.
+func decodeWebP(r io.Reader) ([]image.Image, []time.Duration, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, nil, errors.New("webp: invalid format")
+	}
+	chunks, err := readWebPChunks(data[12:])
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(chunks) == 0 || chunks[0].fourcc != "VP8X" || len(chunks[0].data) < 10 || chunks[0].data[0]&webpAnimationFlag == 0 {
+		img, err := webp.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, err
+		}
+		return []image.Image{img}, []time.Duration{0}, nil
+	}
+
+	canvasWidth := readUint24(chunks[0].data[4:]) + 1
+	canvasHeight := readUint24(chunks[0].data[7:]) + 1
+	canvas := image.NewNRGBA(image.Rect(0, 0, canvasWidth, canvasHeight))
+
+	frames := []image.Image{}
+	delays := []time.Duration{}
+	var disposeRect *image.Rectangle
+	for _, chunk := range chunks {
+		if chunk.fourcc != "ANMF" {
+			continue
+		}
+		if len(chunk.data) < 16 {
+			return nil, nil, errors.New("webp: truncated animation frame")
+		}
+		x := readUint24(chunk.data[0:]) * 2
+		y := readUint24(chunk.data[3:]) * 2
+		width := readUint24(chunk.data[6:]) + 1
+		height := readUint24(chunk.data[9:]) + 1
+		delay := time.Duration(readUint24(chunk.data[12:])) * time.Millisecond
+		if delay == 0 {
+			delay = webpDefaultDelay
+		}
+		blend := chunk.data[15]&0x02 == 0
+		dispose := chunk.data[15]&0x01 != 0
+
+		frame, err := decodeWebPFrame(chunk.data[16:], width, height)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if disposeRect != nil {
+			draw.Draw(canvas, *disposeRect, image.Transparent, image.Point{}, draw.Src)
+			disposeRect = nil
+		}
+		frameRect := image.Rect(x, y, x+width, y+height)
+		if blend {
+			draw.Draw(canvas, frameRect, frame, frame.Bounds().Min, draw.Over)
+		} else {
+			draw.Draw(canvas, frameRect, frame, frame.Bounds().Min, draw.Src)
+		}
+		if dispose {
+			disposeRect = &frameRect
+		}
+
+		snapshot := image.NewNRGBA(canvas.Bounds())
+		copy(snapshot.Pix, canvas.Pix)
+		frames = append(frames, snapshot)
+		delays = append(delays, delay)
+	}
+	if len(frames) == 0 {
+		return nil, nil, errors.New("webp: animation without frames")
+	}
+	return frames, delays, nil
+}
+
+// Wrap a frame's bitstream into a standalone WebP file the decoder understands.
+func decodeWebPFrame(data []byte, width int, height int) (image.Image, error) {
+	chunks, err := readWebPChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	body := bytes.Buffer{}
+	body.WriteString("WEBP")
+	for _, chunk := range chunks {
+		if chunk.fourcc == "ALPH" {
+			header := make([]byte, 10)
+			header[0] = webpAlphaFlag
+			header[4], header[5], header[6] = byte(width-1), byte((width-1)>>8), byte((width-1)>>16)
+			header[7], header[8], header[9] = byte(height-1), byte((height-1)>>8), byte((height-1)>>16)
+			writeWebPChunk(&body, "VP8X", header)
+			break
+		}
+	}
+	for _, chunk := range chunks {
+		if chunk.fourcc == "ALPH" || chunk.fourcc == "VP8 " || chunk.fourcc == "VP8L" {
+			writeWebPChunk(&body, chunk.fourcc, chunk.data)
+		}
+	}
+
+	file := bytes.Buffer{}
+	file.WriteString("RIFF")
+	binary.Write(&file, binary.LittleEndian, uint32(body.Len()))
+	file.Write(body.Bytes())
+	return webp.Decode(bytes.NewReader(file.Bytes()))
+}